@@ -0,0 +1,170 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Aggregates of a field over a group of records
+type AggregateResult struct {
+	// value of the group-by field, nil if the records are not grouped
+	Group interface{}
+	// number of the records of the group
+	Count int64
+	// aggregates of the numeric values of the field, records without one are only counted
+	Sum float64
+	Min float64
+	Max float64
+	Avg float64
+
+	// number of the numeric values
+	values int64
+	// group in the order of the values (see sortValue)
+	key string
+}
+
+func (r *AggregateResult) add(value float64) {
+	if r.values == 0 || value < r.Min {
+		r.Min = value
+	}
+	if r.values == 0 || value > r.Max {
+		r.Max = value
+	}
+	r.Sum += value
+	r.values++
+}
+
+func (r *AggregateResult) merge(other *AggregateResult) {
+	r.Count += other.Count
+	if other.values == 0 {
+		return
+	}
+	if r.values == 0 || other.Min < r.Min {
+		r.Min = other.Min
+	}
+	if r.values == 0 || other.Max > r.Max {
+		r.Max = other.Max
+	}
+	r.Sum += other.Sum
+	r.values += other.values
+}
+
+// Computes count, sum, min, max and avg of the field over the records which satisfy the condition
+// (nil matches every record), grouped by the value of another field if groupBy is set, e.g. users per age:
+//	results, err := c.Aggregate("", "Age", nil)
+// The shards are aggregated in parallel at the same point in time, the groups are ordered by their values
+func (c *Collection) Aggregate(field, groupBy string, where Condition) ([]*AggregateResult, error) {
+	c.layout.enter()
+	defer c.layout.leave()
+	var keys indexKeys
+	if where != nil {
+		keys = c.Map.indexKeys(where.comparisons())
+	}
+	// every shard is read as of the same time
+	ts := c.Map.clock.openSnapshot()
+	defer c.Map.clock.closeSnapshot(ts)
+	partials := make([]map[string]*AggregateResult, len(c.Map.Shared))
+	errs := make([]error, len(c.Map.Shared))
+	wg := sync.WaitGroup{}
+	for i, shard := range c.Map.Shared {
+		wg.Add(1)
+		go func(i int, shard *ConcurrentMapShared) {
+			defer wg.Done()
+			groups := make(map[string]*AggregateResult)
+			errs[i] = c.eachInShardAt(shard, where, ts, keys, func(e *Element) bool {
+				r := newQueryRecord(e)
+				key := ""
+				if groupBy != "" {
+					key = groupKey(r, groupBy)
+				}
+				group, ok := groups[key]
+				if !ok {
+					group = &AggregateResult{key: key}
+					if groupBy != "" {
+						group.Group = groupValue(r, groupBy)
+					}
+					groups[key] = group
+				}
+				group.Count++
+				if value, ok := numericValue(r, field); ok {
+					group.add(value)
+				}
+				return true
+			})
+			partials[i] = groups
+		}(i, shard)
+	}
+	wg.Wait()
+	merged := make(map[string]*AggregateResult)
+	for i, groups := range partials {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		for key, group := range groups {
+			if total, ok := merged[key]; ok {
+				total.merge(group)
+			} else {
+				merged[key] = group
+			}
+		}
+	}
+	results := make([]*AggregateResult, 0, len(merged))
+	for _, group := range merged {
+		if group.values > 0 {
+			group.Avg = group.Sum / float64(group.values)
+		}
+		results = append(results, group)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].key < results[j].key })
+	return results, nil
+}
+
+// returns the key of the group of the record, the values of the struct fields are encoded
+// like the values of the range indexes so that the groups are ordered by the values
+func groupKey(r *queryRecord, field string) string {
+	if r.payload.Kind() == reflect.Struct {
+		f := r.payload.FieldByName(field)
+		if f.IsValid() && f.CanInterface() {
+			value := f.Interface()
+			if encoded, err := RangeValue(value); err == nil {
+				return encoded
+			}
+			return fmt.Sprint(value)
+		}
+	}
+	return r.indexes[field]
+}
+
+// returns the value of the field of the struct, or its index value if the struct has no such field
+func groupValue(r *queryRecord, field string) interface{} {
+	if r.payload.Kind() == reflect.Struct {
+		f := r.payload.FieldByName(field)
+		if f.IsValid() && f.CanInterface() {
+			return f.Interface()
+		}
+	}
+	return r.indexes[field]
+}
+
+// returns the value of the field as a number, false if it is not one
+func numericValue(r *queryRecord, field string) (float64, bool) {
+	if field == "" {
+		return 0, false
+	}
+	if r.payload.Kind() == reflect.Struct {
+		f := r.payload.FieldByName(field)
+		if f.IsValid() && f.CanInterface() {
+			return toFloat(f.Interface())
+		}
+	}
+	data, ok := r.indexes[field]
+	if !ok || strings.HasPrefix(data, RANGE_MARKER) {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(data, 64)
+	return number, err == nil
+}
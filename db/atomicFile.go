@@ -0,0 +1,65 @@
+package db
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const TEMP_FILE_SUFFIX = ".tmp"
+
+// Writes the file through a temporary one (write, fsync, rename, fsync of the directory),
+// so after a crash the file contains either its old or its new version, never a mix of them
+func WriteFileAtomic(name string, write func(w io.Writer) error) error {
+	tmp := name + TEMP_FILE_SUFFIX
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return SyncDir(filepath.Dir(name))
+}
+
+// Writes the data into the file atomically, see WriteFileAtomic
+func WriteBytesAtomic(name string, data []byte) error {
+	return WriteFileAtomic(name, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// flushes the directory entries (file creations and renames) to the drive
+func SyncDir(dir string) error {
+	// directories can not be synced on windows, renames are durable there by themselves
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"reflect"
+	"sync"
+)
+
+// Names of the record codecs (see CollectionOptions.Codec)
+const (
+	CODEC_GOB     = "gob"
+	CODEC_JSON    = "json"
+	CODEC_MSGPACK = "msgpack"
+	// not built in, the codec has to be registered through RegisterCodec (see NewProtobufCodec)
+	CODEC_PROTOBUF = "protobuf"
+)
+
+// Encodes the records of a collection. Payloads of the records are interfaces, so the codecs that do not
+// keep Go types store the name the payload type was registered under (see Database.RegisterTypeName)
+type Codec interface {
+	Encode(e *Element) ([]byte, error)
+	Decode(data []byte) (*Element, error)
+}
+
+var codecs = map[string]Codec{
+	CODEC_GOB:     gobCodec{},
+	CODEC_JSON:    jsonCodec{},
+	CODEC_MSGPACK: msgpackCodec{},
+}
+var codecsMx sync.RWMutex
+
+// makes the codec available to the collections under the name, e.g. the CODEC_PROTOBUF one.
+// A collection has to be loaded with the codec it was created with
+func RegisterCodec(name string, codec Codec) {
+	codecsMx.Lock()
+	codecs[name] = codec
+	codecsMx.Unlock()
+}
+
+func lookupCodec(name string) (Codec, bool) {
+	codecsMx.RLock()
+	defer codecsMx.RUnlock()
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// payload types by the names they are stored under
+var payloadTypes = struct {
+	byName map[string]reflect.Type
+	names  map[reflect.Type]string
+	mx     sync.RWMutex
+}{make(map[string]reflect.Type), make(map[reflect.Type]string), sync.RWMutex{}}
+
+func registerPayloadType(name string, value CustomStructure) {
+	t := reflect.TypeOf(value)
+	payloadTypes.mx.Lock()
+	payloadTypes.byName[name] = t
+	payloadTypes.names[t] = name
+	payloadTypes.mx.Unlock()
+}
+
+// returns the name of the type of the payload, the type has to be registered
+func payloadTypeName(payload interface{}) (string, error) {
+	t := reflect.TypeOf(payload)
+	payloadTypes.mx.RLock()
+	name, ok := payloadTypes.names[t]
+	payloadTypes.mx.RUnlock()
+	if !ok {
+		return "", errors.New("payload type " + t.String() + " is not registered")
+	}
+	return name, nil
+}
+
+// decodes the payload into a new value of the type registered under the name
+func decodePayload(name string, unmarshal func(v interface{}) error) (interface{}, error) {
+	payloadTypes.mx.RLock()
+	t, ok := payloadTypes.byName[name]
+	payloadTypes.mx.RUnlock()
+	if !ok {
+		return nil, errors.New("payload type " + name + " is not registered")
+	}
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		return v.Interface(), unmarshal(v.Interface())
+	}
+	v := reflect.New(t)
+	err := unmarshal(v.Interface())
+	return v.Elem().Interface(), err
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(e *Element) ([]byte, error) {
+	return EncodeGob(e)
+}
+
+func (gobCodec) Decode(data []byte) (*Element, error) {
+	e := new(Element)
+	return e, GetGobDecoder(data).Decode(e)
+}
+
+// a record as it is stored by the JSON codec, readable without the Go types
+type jsonRecord struct {
+	Id      string          `json:"x"`
+	Version uint64          `json:"v"`
+	Type    string          `json:"t"`
+	Payload json.RawMessage `json:"p"`
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(e *Element) ([]byte, error) {
+	name, err := payloadTypeName(e.Payload)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(e.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonRecord{e.Id, e.Version, name, payload})
+}
+
+func (jsonCodec) Decode(data []byte) (*Element, error) {
+	var r jsonRecord
+	err := json.Unmarshal(data, &r)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := decodePayload(r.Type, func(v interface{}) error {
+		return json.Unmarshal(r.Payload, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Element{r.Id, payload, r.Version}, nil
+}
+
+// a record as it is stored by the MessagePack codec, the payload is a nested MessagePack value
+type msgpackRecord struct {
+	Id      string             `msgpack:"x"`
+	Version uint64             `msgpack:"v"`
+	Type    string             `msgpack:"t"`
+	Payload msgpack.RawMessage `msgpack:"p"`
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(e *Element) ([]byte, error) {
+	name, err := payloadTypeName(e.Payload)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := msgpack.Marshal(e.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(&msgpackRecord{e.Id, e.Version, name, payload})
+}
+
+func (msgpackCodec) Decode(data []byte) (*Element, error) {
+	var r msgpackRecord
+	err := msgpack.Unmarshal(data, &r)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := decodePayload(r.Type, func(v interface{}) error {
+		return msgpack.Unmarshal(r.Payload, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Element{r.Id, payload, r.Version}, nil
+}
+
+// a record of the protobuf codec, the payload is a serialized protobuf message
+type protobufRecord struct {
+	Id      string `msgpack:"x"`
+	Version uint64 `msgpack:"v"`
+	Type    string `msgpack:"t"`
+	Payload []byte `msgpack:"p"`
+}
+
+type protobufCodec struct {
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, v interface{}) error
+}
+
+// Creates a codec that stores the payloads as protobuf messages, shardb does not depend on protobuf itself,
+// so the functions of the protobuf library are passed in (the payload types have to be generated messages):
+//	db.RegisterCodec(db.CODEC_PROTOBUF, db.NewProtobufCodec(
+//		func(v interface{}) ([]byte, error) { return proto.Marshal(v.(proto.Message)) },
+//		func(data []byte, v interface{}) error { return proto.Unmarshal(data, v.(proto.Message)) }))
+func NewProtobufCodec(marshal func(v interface{}) ([]byte, error), unmarshal func(data []byte, v interface{}) error) Codec {
+	return &protobufCodec{marshal, unmarshal}
+}
+
+func (c *protobufCodec) Encode(e *Element) ([]byte, error) {
+	name, err := payloadTypeName(e.Payload)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := c.marshal(e.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(&protobufRecord{e.Id, e.Version, name, payload})
+}
+
+func (c *protobufCodec) Decode(data []byte) (*Element, error) {
+	var r protobufRecord
+	err := msgpack.Unmarshal(data, &r)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := decodePayload(r.Type, func(v interface{}) error {
+		return c.unmarshal(r.Payload, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Element{r.Id, payload, r.Version}, nil
+}
@@ -1,14 +1,10 @@
 package db
 
 import (
-	"bufio"
-	"bytes"
-	"compress/gzip"
-	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"github.com/allegro/bigcache"
-	"io/ioutil"
+	"github.com/rs/xid"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -36,35 +32,58 @@ type Collection struct {
 	ShardDestinations map[string]*int `json:"dests"`
 	sharedDestMx      sync.RWMutex    `json:"-"`
 
-	ObjectsCounter  int64  `json:"objects"`
-	SyncDestination string `json:"sync_dest"`
+	ObjectsCounter  int64             `json:"objects"`
+	SyncDestination string            `json:"sync_dest"`
+	Options         CollectionOptions `json:"options"`
+
+	manifest *Manifest  `json:"-"`
+	syncMx   sync.Mutex `json:"-"`
+
+	compactor   *Compactor `json:"-"`
+	compactorMx sync.Mutex `json:"-"`
+
+	results *queryCache `json:"-"`
+	layout  layoutLock  `json:"-"`
 }
 
 type Element struct {
 	Id      string      `json:"x"`
 	Payload interface{} `json:"p"`
+	// starts from 1 and grows with every update of the record, 0 for the records written by the older versions
+	Version uint64 `json:"v"`
 }
 
 func NewCollectionCache() *bigcache.BigCache {
+	return newCacheStore(CacheOptions{}, nil)
+}
+
+func newCacheStore(opts CacheOptions, onRemove func(key string, entry []byte, reason bigcache.RemoveReason)) *bigcache.BigCache {
+	lifeWindow := opts.TTL
+	if lifeWindow <= 0 {
+		lifeWindow = 10 * time.Minute
+	}
+	maxSize := opts.SizeMB
+	if maxSize <= 0 {
+		maxSize = int(GetFreeMemory() / 4)
+	}
 	config := bigcache.Config{
 		// number of shards (must be a power of 2)
 		Shards: 1024,
 		// time after which entry can be evicted
-		LifeWindow: 10 * time.Minute,
+		LifeWindow: lifeWindow,
 		// rps * lifeWindow, used only in initial memory allocation
 		MaxEntriesInWindow: 1000 * 10 * 60,
 		// max entry size in bytes, used only in initial memory allocation
 		MaxEntrySize: 512,
 		// prints information about additional memory allocation
-		Verbose: true,
+		Verbose: opts.Verbose,
 		// cache will not allocate more memory than this limit, value in MB
 		// if value is reached then the oldest entries can be overridden for the new ones
 		// 0 value means no size limit
-		HardMaxCacheSize: int(GetFreeMemory() / 4),
+		HardMaxCacheSize: maxSize,
 		// callback fired when the oldest entry is removed because of its
-		// expiration time or no space left for the new entry. Default value is nil which
-		// means no callback and it prevents from unwrapping the oldest entry.
-		OnRemove: nil,
+		// expiration time or no space left for the new entry
+		OnRemoveWithReason: onRemove,
 	}
 
 	bc, _ := bigcache.NewBigCache(config)
@@ -72,12 +91,24 @@ func NewCollectionCache() *bigcache.BigCache {
 }
 
 func NewCollection(path, name string, cm *ConcurrentMap, sd map[string]*int) *Collection {
-	return &Collection{name, cm, NewCollectionCache(),
-		sd, sync.RWMutex{}, 0, path}
+	return NewCollectionWithOptions(path, name, cm, sd, CollectionOptions{})
+}
+
+func NewCollectionWithOptions(path, name string, cm *ConcurrentMap, sd map[string]*int, opts CollectionOptions) *Collection {
+	c := &Collection{name, cm, nil,
+		sd, sync.RWMutex{}, 0, path, opts, NewManifest(path), sync.Mutex{}, nil, sync.Mutex{}, nil, layoutLock{}}
+	c.useCache(opts.Cache)
+	return c
+}
+
+func CollectionDescriptorName(name string) string {
+	return name + ".json.gzip"
 }
 
 //! Not intended to use in production
 func (c *Collection) GetRandomAliveObject() (string, *Element, error) {
+	c.layout.enter()
+	defer c.layout.leave()
 	shard := c.Map.GetRandomShard()
 	if shard == nil {
 		return "", nil, errors.New("collections does not have any shards")
@@ -89,7 +120,7 @@ func (c *Collection) GetRandomAliveObject() (string, *Element, error) {
 			return "", nil, errors.New("collections does not have any shards")
 		}
 		attempts++
-		if attempts >= SHARD_COUNT {
+		if attempts >= len(c.Map.Shared) {
 			return "", nil, errors.New("too many attempts")
 		}
 	}
@@ -118,40 +149,135 @@ func (c *Collection) StringifyDataIndex(index []*FullDataIndex) (result string)
 }
 
 func (c *Collection) DecodeElement(data []byte) (*Element, error) {
-	e := new(Element)
-	return e, gob.NewDecoder(bytes.NewReader(data)).Decode(e)
+	return c.Map.format.decode(data)
 }
 
 func (c *Collection) Size() int64 {
 	return atomic.LoadInt64(&c.ObjectsCounter)
 }
 
-// synchronizes the collection with the hard drive
+// synchronizes the collection with the hard drive.
+// Metadata files are written as a new generation that becomes current once the manifest is committed.
+// Works as a checkpoint of the write-ahead log: once the shards are saved, the log entries are no longer needed
 func (c *Collection) Sync() (err error) {
+	c.syncMx.Lock()
+	defer c.syncMx.Unlock()
+
+	walGen, err := c.Map.wal.Rotate()
+	if err != nil {
+		return err
+	}
 	err = c.Map.Flush()
 	if err != nil {
 		// very critical error
 		return err
 	}
-	err = c.Map.Sync()
+	gen := c.manifest.Next()
+	names, err := c.Map.Sync(gen)
+	if err != nil {
+		return err
+	}
+	descriptor, err := c.saveDescriptor(gen)
+	if err != nil {
+		return err
+	}
+	err = c.manifest.Commit(gen, append(names, descriptor))
 	if err != nil {
 		return err
 	}
+	err = c.manifest.RemoveStale()
+	if err != nil {
+		return err
+	}
+	return c.Map.wal.Remove(walGen)
+}
+
+// saves the description of the collection under the given generation, returns the name of the file
+func (c *Collection) saveDescriptor(gen uint64) (string, error) {
 	c.sharedDestMx.Lock()
-	defer c.sharedDestMx.Unlock()
 	data, err := json.Marshal(c)
+	c.sharedDestMx.Unlock()
 	if err != nil {
-		return err
+		return "", err
 	}
-	p := NewCompressedPackage(c.SyncDestination+"/"+c.Name+".json.gzip", data)
-	return p.Save()
+	descriptor := CollectionDescriptorName(c.Name)
+	p := NewCompressedPackage(c.SyncDestination+"/"+generationName(descriptor, gen), data)
+	return descriptor, p.Save()
 }
 
-func (c *Collection) Optimize() (int64, error) {
-	return c.Map.OptimizeShards()
+// deletes redundant data from the drive shard by shard (see compactShard)
+// n - total size of the data that has been removed
+func (c *Collection) Optimize() (n int64, err error) {
+	for _, shard := range c.shards() {
+		reclaimed, err := c.compactShard(shard, nil)
+		if err != nil {
+			return n, err
+		}
+		n += reclaimed
+	}
+	// the memory of the cached results is given back together with the space of the drive
+	c.results.reset()
+	return n, nil
+}
+
+// applies an entry of the write-ahead log that is not yet reflected in the loaded shards
+func (c *Collection) replay(e *walEntry) error {
+	if e.Shard < 0 || e.Shard >= len(c.Map.Shared) {
+		// a shard dropped by Reshard, every shard of the new layout has its changes
+		if e.Shard >= 0 && e.Seq <= c.Map.Shared[0].Seq {
+			return nil
+		}
+		return errors.New("write-ahead log refers to an invalid shard")
+	}
+	shard := c.Map.Shared[e.Shard]
+	if e.Seq <= shard.Seq {
+		// the shard metadata already has the change (e.g. it was saved by a compaction),
+		// but the collection description could be older than the shard
+		if _, ok := shard.Items[e.Keys[len(e.Keys)-1]]; ok && (e.Op == walOpWrite || e.Op == walOpUpdate) {
+			c.setDestinations(e.Keys, shard)
+		}
+		return nil
+	}
+	shard.Seq = e.Seq
+	switch e.Op {
+	case walOpWrite:
+		// the data might not have reached the drive before the crash
+		_, err := shard.file.WriteAt(e.Data, e.Offset.Start)
+		if err != nil {
+			return err
+		}
+		// the record is already known if the index of the shard was rebuilt from the data file
+		if _, ok := shard.Items[e.Keys[len(e.Keys)-1]]; !ok {
+			offset := e.Offset
+			shard.insert(&offset, e.Keys)
+		}
+		c.setDestinations(e.Keys, shard)
+	case walOpUpdate:
+		_, err := shard.file.WriteAt(e.Data, e.Offset.Start)
+		if err != nil {
+			return err
+		}
+		offset := e.Offset
+		// a rebuilt index might already have this version or even a later one
+		if old, ok := shard.Items[e.Keys[len(e.Keys)-1]]; !ok {
+			shard.insert(&offset, e.Keys)
+		} else if old.Start < offset.Start {
+			shard.replace(old, &offset, e.Removed, e.Keys)
+		}
+		c.setDestinations(e.Keys, shard)
+	case walOpDelete, walOpRestore:
+		for _, key := range e.Keys {
+			if item, ok := shard.Items[key]; ok {
+				shard.setDeleted(item, e.Op == walOpDelete)
+			}
+		}
+	}
+	return nil
 }
 
 func (c *Collection) RestoreN(entry CustomStructure, limit int) (int, error) {
+	c.layout.enter()
+	defer c.layout.leave()
 	counter, err := c.iterateIndexes(entry, limit, c.restoreByUniqueIndex, c.restoreByIndex)
 	if err != nil {
 		return counter, err
@@ -161,25 +287,30 @@ func (c *Collection) RestoreN(entry CustomStructure, limit int) (int, error) {
 }
 
 func (c *Collection) Restore(entry CustomStructure) (int, error) {
-	const limit = 1000
-	return c.RestoreN(entry, limit)
+	return c.RestoreN(entry, SCAN_LIMIT)
 }
 
 // part of the memory will be marked as "deleted". Actual memory will be released after compression
 func (c *Collection) DeleteById(id string) error {
+	c.layout.enter()
+	defer c.layout.leave()
 	idKey := "id:" + id
-	c.Cache.Set(idKey, nil)
 	shard, err := c.getShardByKeySafe(idKey)
 	if err != nil {
 		return err
 	}
-	c.Map.DeleteById(shard, id)
+	err = c.Map.DeleteById(shard, id)
+	if err != nil {
+		return err
+	}
 	//c.deleteDestination(idKey)
 	atomic.AddInt64(&c.ObjectsCounter, -1)
 	return nil
 }
 
 func (c *Collection) DeleteN(entry CustomStructure, limit int) (int, error) {
+	c.layout.enter()
+	defer c.layout.leave()
 	counter, err := c.iterateIndexes(entry, limit, c.deleteByUniqueIndex, c.deleteByIndex)
 	if err != nil {
 		return counter, err
@@ -189,73 +320,173 @@ func (c *Collection) DeleteN(entry CustomStructure, limit int) (int, error) {
 }
 
 func (c *Collection) Delete(entry CustomStructure) (int, error) {
-	const limit = 1000
-	return c.DeleteN(entry, limit)
+	return c.DeleteN(entry, SCAN_LIMIT)
 }
 
 func (c *Collection) Write(payload CustomStructure) error {
-	destMap, err := c.Map.Set(payload.GetDataIndex(), payload)
+	return c.write(xid.New().String(), payload)
+}
+
+func (c *Collection) write(id string, payload CustomStructure) error {
+	c.layout.enter()
+	defer c.layout.leave()
+	destMap, err := c.Map.set(id, payload.GetDataIndex(), payload)
 	if err != nil {
 		return err
 	}
+	if c.Options.Placement == PLACEMENT_ROUND_ROBIN {
+		c.sharedDestMx.Lock()
+		for k, v := range destMap {
+			c.ShardDestinations[k] = v
+		}
+		c.sharedDestMx.Unlock()
+	}
+	destMap = nil
+	atomic.AddInt64(&c.ObjectsCounter, 1)
+	return nil
+}
+
+// rewrites the payload of the record, the id is kept. Keys of the changed index values are moved to the new ones
+func (c *Collection) Update(id string, payload CustomStructure) error {
+	_, err := c.update(id, ANY_VERSION, payload)
+	return err
+}
+
+func (c *Collection) update(id string, expected uint64, payload CustomStructure) (uint64, error) {
+	c.layout.enter()
+	defer c.layout.leave()
+	idKey := "id:" + id
+	shard, err := c.getShardByKeySafe(idKey)
+	if err != nil {
+		return 0, err
+	}
+	destMap, removed, version, err := c.Map.CompareAndSwap(shard, id, expected, payload.GetDataIndex(), payload)
+	if err != nil {
+		return 0, err
+	}
+	c.moveDestinations(shard, removed, destMap)
+	return version, nil
+}
+
+// drops the destinations of the keys an updated record has lost and adds the new ones
+func (c *Collection) moveDestinations(shard *ConcurrentMapShared, removed []string, destMap map[string]*int) {
+	if c.Options.Placement == PLACEMENT_HASH {
+		return
+	}
 	c.sharedDestMx.Lock()
+	for _, key := range removed {
+		if dest, ok := c.ShardDestinations[key]; ok && *dest == shard.Id {
+			delete(c.ShardDestinations, key)
+		}
+	}
 	for k, v := range destMap {
 		c.ShardDestinations[k] = v
 	}
 	c.sharedDestMx.Unlock()
-	destMap = nil
-	atomic.AddInt64(&c.ObjectsCounter, 1)
-	return nil
+}
+
+// passes every record matching the filter (see Scan) to fn and rewrites it with the returned payload,
+// records for which fn returns nil are left untouched. Returns the number of the updated records
+func (c *Collection) UpdateWhere(filter CustomStructure, fn func(payload CustomStructure) (CustomStructure, error)) (int, error) {
+	dataSet, err := c.Scan(filter, false)
+	if err != nil {
+		return 0, err
+	}
+	counter := 0
+	for _, data := range dataSet {
+		el, err := c.DecodeElement(data)
+		if err != nil {
+			return counter, err
+		}
+		payload, ok := el.Payload.(CustomStructure)
+		if !ok {
+			return counter, errors.New("record " + el.Id + " does not implement CustomStructure")
+		}
+		updated, err := fn(payload)
+		if err != nil {
+			return counter, err
+		}
+		if updated == nil {
+			continue
+		}
+		err = c.Update(el.Id, updated)
+		if err != nil {
+			return counter, err
+		}
+		counter++
+	}
+	return counter, nil
+}
+
+// updates the record that holds a unique key of the payload or writes a new one if there is none.
+// A deleted record is not brought back, an error is returned instead. Returns the id of the record
+func (c *Collection) Upsert(payload CustomStructure) (string, error) {
+	for {
+		for _, ix := range payload.GetDataIndex() {
+			if !ix.Unique || ix.Data == "" {
+				continue
+			}
+			if id, ok := c.Map.uniqueOwner(ix.Field + ":" + ix.Data); ok {
+				return id, c.Update(id, payload)
+			}
+		}
+		id := xid.New().String()
+		err := c.write(id, payload)
+		if _, ok := err.(*ErrDuplicateKey); ok {
+			// the key was taken in the meantime
+			continue
+		}
+		return id, err
+	}
 }
 
 func (c *Collection) FindById(id string, cacheResult bool) ([]byte, error) {
+	c.layout.enter()
+	defer c.layout.leave()
 	idKey := "id:" + id
-	dataInterface, err := c.loadCache(idKey)
-	if err == nil && dataInterface != nil {
-		return dataInterface.([]byte), nil
+	var data []byte
+	if c.results.get(idKey, &data) {
+		return data, nil
 	}
+	gen := c.results.begin()
 	shard := c.getShardByKey(idKey)
 	data, err := c.Map.FindById(shard, id)
 	if err != nil {
 		return nil, err
 	}
 	if cacheResult {
-		c.cache(idKey, data)
+		c.results.put(gen, idKey, []string{idKey}, data)
 	}
 	return data, nil
 }
 
 func (c *Collection) ScanN(entry CustomStructure, limit int, cacheResult bool) ([][]byte, error) {
+	c.layout.enter()
+	defer c.layout.leave()
 	indexes := entry.GetDataIndex()
-	indexesString := c.StringifyDataIndex(indexes)
-	dataInterface, err := c.loadCache(indexesString)
-	if err == nil && dataInterface != nil {
-		return dataInterface.([][]byte), nil
+	cacheKey := c.scanCacheKey(indexes, limit)
+	var dataSet [][]byte
+	if c.results.get(cacheKey, &dataSet) {
+		return dataSet, nil
 	}
-	for _, ix := range indexes {
-		if ix.Data == "" {
-			continue
-		}
-		if ix.Unique {
-			data, err := c.scanByUniqueIndex(entry, ix)
-			if err != nil {
-				return nil, err
-			}
-			if cacheResult {
-				c.cache(indexesString, data)
-			}
-			return [][]byte{data}, nil
-		}
-		dataSet, err := c.scanByIndex(entry, ix, limit)
+	gen := c.results.begin()
+	// the indexes the probe is looked up by (see QueryPlan)
+	p, err := c.plan(entry)
+	if err != nil {
+		return nil, err
+	}
+	dataSet, err = c.execute(p, limit, latest)
+	if err != nil {
+		return nil, err
+	}
+	if cacheResult {
+		deps, err := c.scanDeps(p, dataSet)
 		if err != nil {
 			return nil, err
 		}
-		if cacheResult {
-			c.cache(indexesString, dataSet)
-		}
-		return dataSet, nil
+		c.results.put(gen, cacheKey, deps, dataSet)
 	}
-	return nil, errors.New("no matching data")
+	return dataSet, nil
 }
 
 func (c *Collection) ScanOne(entry CustomStructure, cacheResult bool) ([]byte, error) {
@@ -267,17 +498,26 @@ func (c *Collection) ScanOne(entry CustomStructure, cacheResult bool) ([]byte, e
 }
 
 func (c *Collection) Scan(entry CustomStructure, cacheResult bool) ([][]byte, error) {
-	const limit = 1000
-	return c.ScanN(entry, limit, cacheResult)
+	return c.ScanN(entry, SCAN_LIMIT, cacheResult)
 }
 
 func (c *Collection) getShardByKey(key string) *ConcurrentMapShared {
+	if c.Options.Placement == PLACEMENT_HASH {
+		shard, _ := c.Map.locate(key)
+		return shard
+	}
 	c.sharedDestMx.RLock()
 	defer c.sharedDestMx.RUnlock()
 	return c.Map.Shared[*c.ShardDestinations[key]]
 }
 
 func (c *Collection) getShardByKeySafe(key string) (*ConcurrentMapShared, error) {
+	if c.Options.Placement == PLACEMENT_HASH {
+		if shard, ok := c.Map.locate(key); ok {
+			return shard, nil
+		}
+		return nil, errors.New("invalid shard destination")
+	}
 	c.sharedDestMx.RLock()
 	defer c.sharedDestMx.RUnlock()
 	if dest, ok := c.ShardDestinations[key]; ok {
@@ -295,8 +535,7 @@ func (c *Collection) restoreByUniqueIndex(entry CustomStructure, index *FullData
 }
 
 func (c *Collection) restoreByIndex(entry CustomStructure, index *FullDataIndex, limit int) (int, error) {
-	counter := c.Map.RestoreByKey(index.Field, index.Data, limit)
-	return counter, nil
+	return c.Map.RestoreByKey(index.Field, index.Data, limit)
 }
 
 func (c *Collection) deleteByUniqueIndex(entry CustomStructure, index *FullDataIndex) error {
@@ -309,7 +548,10 @@ func (c *Collection) deleteByUniqueIndex(entry CustomStructure, index *FullDataI
 }
 
 func (c *Collection) deleteByIndex(entry CustomStructure, index *FullDataIndex, limit int) (int, error) {
-	deletedDests := c.Map.DeleteByKey(index.Field, index.Data, limit)
+	deletedDests, err := c.Map.DeleteByKey(index.Field, index.Data, limit)
+	if err != nil {
+		return len(deletedDests), err
+	}
 	/*c.sharedDestMx.Lock()
 	for _, d := range deletedDests {
 		delete(c.ShardDestinations, d)
@@ -318,28 +560,21 @@ func (c *Collection) deleteByIndex(entry CustomStructure, index *FullDataIndex,
 	return len(deletedDests), nil
 }
 
-func (c *Collection) deleteDestination(key string) {
+func (c *Collection) setDestinations(keys []string, shard *ConcurrentMapShared) {
+	if c.Options.Placement == PLACEMENT_HASH {
+		return
+	}
 	c.sharedDestMx.Lock()
-	delete(c.ShardDestinations, key)
-	c.sharedDestMx.Unlock()
-}
-
-func (c *Collection) scanByUniqueIndex(entry CustomStructure, index *FullDataIndex) ([]byte, error) {
-	shard, err := c.getShardByKeySafe(index.Field + ":" + index.Data)
-	if err != nil {
-		return nil, err
+	for _, key := range keys {
+		c.ShardDestinations[key] = &shard.Id
 	}
-	return c.Map.FindByUniqueKey(shard, index.Field, index.Data)
+	c.sharedDestMx.Unlock()
 }
 
-func (c *Collection) scanByIndex(entry CustomStructure, index *FullDataIndex, limit int) ([][]byte, error) {
-	data, err := c.Map.FindByKey(index.Field, index.Data, limit)
-	if err != nil {
-		return nil, err
-	} else if len(data) == 0 {
-		return nil, errors.New("zero results")
-	}
-	return data, nil
+func (c *Collection) deleteDestination(key string) {
+	c.sharedDestMx.Lock()
+	delete(c.ShardDestinations, key)
+	c.sharedDestMx.Unlock()
 }
 
 func (c *Collection) iterateIndexes(entry CustomStructure, limit int, ucb UniqueIndexFunc, cb IndexFunc) (int, error) {
@@ -365,36 +600,3 @@ func (c *Collection) iterateIndexes(entry CustomStructure, limit int, ucb Unique
 	}
 	return counter, nil
 }
-
-func (c *Collection) cache(key string, dataInterface interface{}) error {
-	var data bytes.Buffer
-	var compressedBuf bytes.Buffer
-	writer := bufio.NewWriter(&compressedBuf)
-	enc := gob.NewEncoder(&data)
-	err := enc.Encode(dataInterface)
-	if err != nil {
-		return err
-	}
-	gzipw, _ := gzip.NewWriterLevel(writer, gzip.BestSpeed)
-	_, err = gzipw.Write(data.Bytes())
-	gzipw.Close()
-	return c.Cache.Set(key, compressedBuf.Bytes())
-}
-
-func (c *Collection) loadCache(key string) (interface{}, error) {
-	data, err := c.Cache.Get(key)
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewBuffer(data)
-	reader, err := gzip.NewReader(buf)
-	if err != nil {
-		return nil, err
-	}
-	defer reader.Close()
-	decompressedData, err := ioutil.ReadAll(reader)
-	if err != nil {
-		return nil, err
-	}
-	return gob.NewDecoder(bytes.NewReader(decompressedData)), nil
-}
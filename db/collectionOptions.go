@@ -0,0 +1,73 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+// Settings of a collection chosen when it is created, they are kept in the descriptor of the collection
+type CollectionOptions struct {
+	// number of the data files of the collection, SHARD_COUNT if 0
+	ShardCount int `json:"shards"`
+	// PLACEMENT_ROUND_ROBIN or PLACEMENT_HASH, can not be changed once the collection is created
+	Placement int `json:"placement"`
+	// encoding of the records (see Codec), CODEC_GOB if empty
+	Codec string `json:"codec"`
+	// COMPRESSION_NONE or COMPRESSION_GZIP, applied to every record
+	Compression int `json:"compression"`
+	// the probe struct is looked up by a single index and the rest of its indexes are ignored,
+	// as the older versions did, otherwise every index that has a value has to match (see QueryPlan)
+	FirstIndex bool         `json:"first_index"`
+	Cache      CacheOptions `json:"cache"`
+}
+
+// fills the defaults in and validates the options
+func (opts CollectionOptions) resolve() (CollectionOptions, *recordFormat, error) {
+	if opts.ShardCount == 0 {
+		opts.ShardCount = SHARD_COUNT
+	}
+	if opts.ShardCount < 0 {
+		return opts, nil, errors.New("invalid shard count")
+	}
+	if opts.Placement != PLACEMENT_ROUND_ROBIN && opts.Placement != PLACEMENT_HASH {
+		return opts, nil, errors.New("invalid placement mode")
+	}
+	format, err := newRecordFormat(opts.Codec, opts.Compression)
+	if err != nil {
+		return opts, nil, err
+	}
+	opts.Codec = format.name
+	return opts, format, nil
+}
+
+// Settings of the cache of the results of FindById and ScanN (see queryCache)
+type CacheOptions struct {
+	// the results are never kept if set
+	Disabled bool `json:"disabled"`
+	// limit of the memory of the cache in MB, a quarter of the free memory if 0
+	SizeMB int `json:"size_mb"`
+	// time after which a result can be evicted, 10 minutes if 0
+	TTL time.Duration `json:"ttl"`
+	// the results are kept as they are instead of gzipped, faster but larger
+	Uncompressed bool `json:"uncompressed"`
+	// prints the additional allocations of the memory
+	Verbose bool `json:"verbose"`
+}
+
+// Counters of the cache of a collection since it was opened
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	// results removed because they expired or there was no space left
+	Evictions int64
+	// results dropped because their records were changed
+	Invalidations int64
+	// number of the cached results
+	Entries int
+	// memory allocated for the cached results
+	Bytes int64
+}
+
+func (c *Collection) CacheStats() CacheStats {
+	return c.results.stats()
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// size of the write buffer of the compacted data file
+var COMPACTION_BUFFER_SIZE = 1 << 20
+
+type slotEntry struct {
+	n    int
+	item *ShardOffset
+}
+
+// Streams the live records of the shard into a new generation of its data file (see Manifest).
+// The shard stays readable and writable while the bulk of the records is copied, the write lock
+// is taken only to copy the records changed in the meantime, to rewrite the offsets in one pass
+// and to switch to the new file. The copy is throttled and can be interrupted through ctl (might be nil).
+// Returns the number of the reclaimed bytes
+func (c *Collection) compactShard(shard *ConcurrentMapShared, ctl *compactionControl) (int64, error) {
+	shard.compactMx.Lock()
+	defer shard.compactMx.Unlock()
+	c.layout.enter()
+	defer c.layout.leave()
+	// the shard was replaced by Reshard while the compaction was waiting
+	if shard.Id >= len(c.Map.Shared) || c.Map.Shared[shard.Id] != shard {
+		return 0, nil
+	}
+	// the open snapshots might read the dropped records and the old versions of the updated ones
+	if c.Map.clock.pinned() {
+		return 0, ErrSnapshotsOpen
+	}
+
+	// collect the live records
+	shard.RLock()
+	fi, err := shard.file.Stat()
+	if err != nil {
+		shard.RUnlock()
+		return 0, err
+	}
+	end := fi.Size()
+	live := make([]ShardOffset, 0, len(shard.Items))
+	seen := make(map[*ShardOffset]bool, len(shard.Items))
+	total := int64(0)
+	for _, item := range shard.Items {
+		if !item.Deleted && !seen[item] {
+			seen[item] = true
+			live = append(live, ShardOffset{Start: item.Start, Length: item.Length})
+			total += int64(item.Length)
+		}
+	}
+	// the data file is replaced only by the compaction itself, so it is safe to read it without the lock
+	src := shard.file
+	shard.RUnlock()
+	seen = nil
+	sort.Slice(live, func(i, j int) bool { return live[i].Start < live[j].Start })
+
+	// the generation is kept from a concurrent Sync until it is committed
+	gen := c.manifest.Next()
+	defer c.manifest.Release(gen)
+	dataName := ShardDataName(shard.Id)
+	out, err := os.OpenFile(c.manifest.PathOf(dataName, gen), os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+	abort := func(err error) (int64, error) {
+		out.Close()
+		os.Remove(out.Name())
+		return 0, err
+	}
+	w := bufio.NewWriterSize(out, COMPACTION_BUFFER_SIZE)
+
+	// old start -> new start
+	moved := make(map[int64]int64, len(live))
+	pos := int64(0)
+	ctl.begin(shard.Id, total)
+	for _, record := range live {
+		_, err = io.Copy(w, io.NewSectionReader(src, record.Start, int64(record.Length)))
+		if err == nil {
+			err = ctl.copied(int64(record.Length))
+		}
+		if err != nil {
+			return abort(err)
+		}
+		moved[record.Start] = pos
+		pos += int64(record.Length)
+	}
+	live = nil
+
+	c.syncMx.Lock()
+	defer c.syncMx.Unlock()
+	// wait for the readers of the old data file
+	shard.fileMx.Lock()
+	defer shard.fileMx.Unlock()
+	shard.Lock()
+	defer shard.Unlock()
+	// snapshots taken from now on read the shard only after the switch
+	if c.Map.clock.pinned() {
+		return abort(ErrSnapshotsOpen)
+	}
+
+	fi, err = shard.file.Stat()
+	if err != nil {
+		return abort(err)
+	}
+	size := fi.Size()
+	// records appended during the copy
+	_, err = io.Copy(w, io.NewSectionReader(shard.file, end, size-end))
+	if err != nil {
+		return abort(err)
+	}
+	tail := pos
+	pos += size - end
+
+	items := make(map[string]*ShardOffset, len(shard.Items))
+	slots := make(map[string][]slotEntry)
+	// record -> its start in the old data file
+	relocated := make(map[*ShardOffset]int64, len(moved))
+	alive := int64(0)
+	// unique keys of the dropped records, released once the new file is committed
+	released := make(map[string][]string)
+	for key, item := range shard.Items {
+		if _, ok := relocated[item]; !ok {
+			newStart, ok := moved[item.Start]
+			if item.Start >= end {
+				newStart, ok = tail+item.Start-end, true
+			}
+			if !ok {
+				if item.Deleted {
+					// the record is dropped with all of its keys
+					if isUniqueKey(key) {
+						released[item.id] = append(released[item.id], key)
+					}
+					continue
+				}
+				// restored during the copy
+				_, err = io.Copy(w, io.NewSectionReader(shard.file, item.Start, int64(item.Length)))
+				if err != nil {
+					return abort(err)
+				}
+				newStart = pos
+				moved[item.Start] = pos
+				pos += int64(item.Length)
+			}
+			relocated[item] = item.Start
+			item.Start = newStart
+			if !item.Deleted {
+				alive += int64(item.Length)
+			}
+		}
+		if n, fullKey, ok := splitSlotKey(key); ok {
+			slots[fullKey] = append(slots[fullKey], slotEntry{n, item})
+		} else {
+			items[key] = item
+		}
+	}
+	// renumber the slots of the regular indexes, so they have no holes left by the dropped records
+	capacities := make(map[string]int, len(slots))
+	for fullKey, entries := range slots {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].n < entries[j].n })
+		for i, e := range entries {
+			items[strconv.Itoa(i)+":"+fullKey] = e.item
+		}
+		capacities["n:"+fullKey] = len(entries) - 1
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		return abort(err)
+	}
+
+	// switch to the new data file together with the metadata that refers to it
+	oldItems, oldCapacities := shard.Items, shard.Capacities
+	shard.Items, shard.Capacities = items, capacities
+	err = shard.save(gen)
+	if err == nil {
+		err = c.manifest.Commit(gen, []string{dataName, ShardMetaName(shard.Id)})
+	}
+	if err != nil {
+		shard.Items, shard.Capacities = oldItems, oldCapacities
+		for item, start := range relocated {
+			item.Start = start
+		}
+		return abort(err)
+	}
+	shard.file.Close()
+	shard.file = out
+	shard.history = nil
+	shard.rebuildRanges()
+	// records deleted or updated during the copy
+	shard.deadBytes = pos - alive
+	for id, keys := range released {
+		c.Map.releaseUniques(id, keys)
+	}
+	return size - pos, c.manifest.RemoveStale()
+}
@@ -0,0 +1,278 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCompactionStopped = errors.New("compaction was stopped")
+
+type CompactorOptions struct {
+	// a shard is compacted once this share of its data file is taken by the deleted records
+	Ratio float64
+	// a shard with less deleted bytes than this is never compacted
+	MinDeadBytes int64
+	// how often the shards are checked
+	Interval time.Duration
+	// throughput limit of the copying, 0 means no limit
+	BytesPerSecond int64
+}
+
+func DefaultCompactorOptions() CompactorOptions {
+	return CompactorOptions{0.5, 1 << 20, time.Minute, 16 << 20}
+}
+
+type CompactorStats struct {
+	Running bool `json:"running"`
+	// shard being compacted right now, -1 if none
+	Shard int `json:"shard"`
+	// part of the live records of the shard copied so far, from 0 to 1
+	Progress       float64 `json:"progress"`
+	Compactions    int64   `json:"compactions"`
+	ReclaimedBytes int64   `json:"reclaimed"`
+	// deleted bytes left in all of the shards as of the last check
+	DeadBytes int64  `json:"dead"`
+	LastError string `json:"last_error"`
+}
+
+// throttles the copying of a compaction and reports its progress
+type compactionControl struct {
+	bytesPerSecond int64
+	stop           chan struct{}
+
+	mx      sync.Mutex
+	shard   int
+	total   int64
+	done    int64
+	started time.Time
+}
+
+func (ctl *compactionControl) begin(shard int, total int64) {
+	if ctl == nil {
+		return
+	}
+	ctl.mx.Lock()
+	ctl.shard, ctl.total, ctl.done, ctl.started = shard, total, 0, time.Now()
+	ctl.mx.Unlock()
+}
+
+func (ctl *compactionControl) end() {
+	ctl.mx.Lock()
+	ctl.shard = -1
+	ctl.mx.Unlock()
+}
+
+// accounts n copied bytes, sleeps if the copying runs ahead of the limit
+func (ctl *compactionControl) copied(n int64) error {
+	if ctl == nil {
+		return nil
+	}
+	ctl.mx.Lock()
+	ctl.done += n
+	done, started := ctl.done, ctl.started
+	ctl.mx.Unlock()
+
+	var wait <-chan time.Time
+	if ctl.bytesPerSecond > 0 {
+		ahead := time.Duration(done*int64(time.Second)/ctl.bytesPerSecond) - time.Since(started)
+		if ahead > 0 {
+			timer := time.NewTimer(ahead)
+			defer timer.Stop()
+			wait = timer.C
+		}
+	}
+	if wait == nil {
+		select {
+		case <-ctl.stop:
+			return ErrCompactionStopped
+		default:
+			return nil
+		}
+	}
+	select {
+	case <-ctl.stop:
+		return ErrCompactionStopped
+	case <-wait:
+		return nil
+	}
+}
+
+func (ctl *compactionControl) progress() (int, float64) {
+	ctl.mx.Lock()
+	defer ctl.mx.Unlock()
+	if ctl.shard < 0 {
+		return -1, 0
+	}
+	if ctl.total == 0 {
+		return ctl.shard, 1
+	}
+	return ctl.shard, float64(ctl.done) / float64(ctl.total)
+}
+
+// Compacts the shards of a collection in the background once their deleted space exceeds the thresholds
+type Compactor struct {
+	collection *Collection
+	opts       CompactorOptions
+	ctl        *compactionControl
+	done       chan struct{}
+
+	mx    sync.Mutex
+	stats CompactorStats
+}
+
+func NewCompactor(c *Collection, opts CompactorOptions) *Compactor {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultCompactorOptions().Interval
+	}
+	ctl := &compactionControl{bytesPerSecond: opts.BytesPerSecond, stop: make(chan struct{}), shard: -1}
+	return &Compactor{c, opts, ctl, make(chan struct{}), sync.Mutex{}, CompactorStats{Shard: -1}}
+}
+
+func (cp *Compactor) Start() {
+	cp.mx.Lock()
+	cp.stats.Running = true
+	cp.mx.Unlock()
+	go cp.run()
+}
+
+// interrupts the current compaction (its shard is left untouched) and waits for the compactor to exit
+func (cp *Compactor) Stop() {
+	cp.mx.Lock()
+	running := cp.stats.Running
+	cp.stats.Running = false
+	cp.mx.Unlock()
+	if running {
+		close(cp.ctl.stop)
+		<-cp.done
+	}
+}
+
+func (cp *Compactor) Stats() CompactorStats {
+	cp.mx.Lock()
+	stats := cp.stats
+	cp.mx.Unlock()
+	stats.Shard, stats.Progress = cp.ctl.progress()
+	return stats
+}
+
+func (cp *Compactor) run() {
+	defer close(cp.done)
+	ticker := time.NewTicker(cp.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cp.ctl.stop:
+			return
+		case <-ticker.C:
+		}
+		cp.check()
+	}
+}
+
+// compacts every shard which exceeds the thresholds
+func (cp *Compactor) check() {
+	dead := int64(0)
+	for _, shard := range cp.collection.shards() {
+		size, shardDead, err := shard.Space()
+		if err != nil {
+			// the data file is closed once the shard is replaced by Reshard
+			if cp.collection.ownsShard(shard) {
+				cp.fail(err)
+			}
+			continue
+		}
+		if shardDead == 0 || shardDead < cp.opts.MinDeadBytes || float64(shardDead) < cp.opts.Ratio*float64(size) {
+			dead += shardDead
+			continue
+		}
+		reclaimed, err := cp.collection.compactShard(shard, cp.ctl)
+		cp.ctl.end()
+		if err == ErrCompactionStopped {
+			return
+		}
+		if err == ErrSnapshotsOpen {
+			// retried on the next check
+			dead += shardDead
+			continue
+		}
+		if err != nil {
+			cp.fail(err)
+			dead += shardDead
+			continue
+		}
+		cp.mx.Lock()
+		cp.stats.Compactions++
+		cp.stats.ReclaimedBytes += reclaimed
+		cp.mx.Unlock()
+		_, shardDead, _ = shard.Space()
+		dead += shardDead
+	}
+	cp.mx.Lock()
+	cp.stats.DeadBytes = dead
+	cp.mx.Unlock()
+}
+
+func (cp *Compactor) fail(err error) {
+	cp.mx.Lock()
+	cp.stats.LastError = err.Error()
+	cp.mx.Unlock()
+}
+
+// starts the background compaction of the collection, the running one is restarted with the new options
+func (c *Collection) StartCompaction(opts CompactorOptions) {
+	c.compactorMx.Lock()
+	defer c.compactorMx.Unlock()
+	if c.compactor != nil {
+		c.compactor.Stop()
+	}
+	c.compactor = NewCompactor(c, opts)
+	c.compactor.Start()
+}
+
+func (c *Collection) StopCompaction() {
+	c.compactorMx.Lock()
+	defer c.compactorMx.Unlock()
+	if c.compactor != nil {
+		c.compactor.Stop()
+	}
+}
+
+func (c *Collection) CompactionStats() CompactorStats {
+	c.compactorMx.Lock()
+	defer c.compactorMx.Unlock()
+	if c.compactor == nil {
+		return CompactorStats{Shard: -1}
+	}
+	return c.compactor.Stats()
+}
+
+// starts the background compaction of all of the existing and future collections
+func (db *Database) StartCompaction(opts CompactorOptions) {
+	db.collectionMutex.Lock()
+	defer db.collectionMutex.Unlock()
+	db.compaction = &opts
+	for _, c := range db.collections {
+		c.StartCompaction(opts)
+	}
+}
+
+func (db *Database) StopCompaction() {
+	db.collectionMutex.Lock()
+	defer db.collectionMutex.Unlock()
+	db.compaction = nil
+	for _, c := range db.collections {
+		c.StopCompaction()
+	}
+}
+
+// returns the compaction stats of every collection
+func (db *Database) CompactionStats() map[string]CompactorStats {
+	db.collectionMutex.RLock()
+	defer db.collectionMutex.RUnlock()
+	stats := make(map[string]CompactorStats, len(db.collections))
+	for name, c := range db.collections {
+		stats[name] = c.CompactionStats()
+	}
+	return stats
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+)
+
+// separates the fields in the name of a composite index
+const COMPOSITE_SEPARATOR = "+"
+
+// Returns an index built from several fields, e.g. (TenantId, Email). Its key is set only if every part
+// has a value, so a probe struct (see Collection.ScanN) uses the composite index once all of its fields are set.
+// A record with an incomplete index is not stored under it.
+// A unique composite index enforces the uniqueness of the combination of the values
+func CompositeIndex(unique bool, parts ...*FullDataIndex) *FullDataIndex {
+	fields := make([]string, 0, len(parts))
+	data := ""
+	complete := true
+	for _, part := range parts {
+		fields = append(fields, part.Field)
+		if part.Data == "" {
+			complete = false
+		}
+		// every value is prefixed with its length, so the values may contain anything
+		data += strconv.Itoa(len(part.Data)) + "|" + part.Data
+	}
+	if !complete {
+		data = ""
+	}
+	return &FullDataIndex{strings.Join(fields, COMPOSITE_SEPARATOR), data, unique}
+}
+
+func isCompositeIndex(field string) bool {
+	return strings.Contains(field, COMPOSITE_SEPARATOR)
+}
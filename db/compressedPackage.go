@@ -1,8 +1,8 @@
 package db
 
 import (
-	"bytes"
 	"compress/gzip"
+	"io"
 	"io/ioutil"
 	"os"
 )
@@ -25,19 +25,16 @@ func (p *CompressedPackage) SetCompressionLevel(level int) {
 	p.compressionLevel = level
 }
 
+// the file is replaced atomically, see WriteFileAtomic
 func (p *CompressedPackage) Save() error {
-	data := bytes.NewBuffer(p.data)
-	f, err := os.Create(p.name)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	gzipw, _ := gzip.NewWriterLevel(f, p.compressionLevel)
-	defer gzipw.Close()
-	_, err = gzipw.Write(data.Bytes())
-
-	return err
+	return WriteFileAtomic(p.name, func(w io.Writer) error {
+		gzipw, _ := gzip.NewWriterLevel(w, p.compressionLevel)
+		_, err := gzipw.Write(p.data)
+		if err != nil {
+			return err
+		}
+		return gzipw.Close()
+	})
 }
 
 func (p *CompressedPackage) Load() ([]byte, error) {
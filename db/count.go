@@ -0,0 +1,86 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Returns the number of the alive records that match the probe struct (see ScanN), an empty probe counts
+// every record. Only the indexes in memory are used, the records are not read
+func (c *Collection) Count(entry CustomStructure) (int, error) {
+	c.layout.enter()
+	defer c.layout.leave()
+	p, err := c.plan(entry)
+	if err != nil {
+		p = nil
+	}
+	n := 0
+	for _, shard := range c.Map.Shared {
+		shard.RLock()
+		if p != nil {
+			n += len(shard.matchAt(p, math.MaxInt32, latest))
+		} else {
+			n += shard.countRecords()
+		}
+		shard.RUnlock()
+	}
+	return n, nil
+}
+
+// Returns the number of the alive records whose index has the value. The value is encoded like the range
+// index (see RangeValue) if the field is one, numbers are converted to the type of its values. Otherwise
+// strings are taken as they are and the rest are formatted with fmt.Sprint
+func (c *Collection) CountByIndex(field string, value interface{}) (int, error) {
+	c.layout.enter()
+	defer c.layout.leave()
+	var data string
+	var err error
+	if kind := c.Map.rangeKind(field); kind != 0 {
+		data, err = rangeOperand(kind, OP_EQ, value)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		data = fmt.Sprint(value)
+	}
+	fullKey := field + ":" + data
+	n := 0
+	for _, shard := range c.Map.Shared {
+		shard.RLock()
+		n += shard.countKey(fullKey)
+		shard.RUnlock()
+	}
+	return n, nil
+}
+
+// returns the number of the alive records under the unique or regular key, must be called under the shard lock
+func (shard *ConcurrentMapShared) countKey(fullKey string) int {
+	if item, ok := shard.Items[fullKey]; ok {
+		if item.Deleted {
+			return 0
+		}
+		return 1
+	}
+	n := 0
+	// the capacity is the highest slot, the deleted records and the holes are skipped
+	capacity := shard.GetCapacityKey(fullKey)
+	for i := 0; i <= capacity; i++ {
+		if item, ok := shard.Items[strconv.Itoa(i)+":"+fullKey]; ok && !item.Deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// returns the number of the alive records of the shard, must be called under the shard lock
+func (shard *ConcurrentMapShared) countRecords() int {
+	n := 0
+	for key, item := range shard.Items {
+		if strings.HasPrefix(key, "id:") && !item.Deleted {
+			n++
+		}
+	}
+	return n
+}
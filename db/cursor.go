@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Walks through the alive records of a collection as of the time it was opened, every record is returned once.
+// Records are read from the drive one by one, only the locations of the records of the current shard are kept
+// in memory. The compaction of the collection is postponed until the cursor is closed
+//	cur := c.Cursor(ctx)
+//	defer cur.Close()
+//	for cur.Next() {
+//		e := cur.Element()
+//	}
+//	err := cur.Err()
+type Cursor struct {
+	ctx        context.Context
+	collection *Collection
+	snapshot   *Snapshot
+	// index of the next shard to read
+	shard   int
+	offsets []ShardOffset
+	element *Element
+	err     error
+}
+
+func (c *Collection) Cursor(ctx context.Context) *Cursor {
+	s := &Snapshot{c.Map.clock, c.Map.clock.openSnapshot(), false, sync.Mutex{}}
+	return &Cursor{ctx, c, s, 0, nil, nil, nil}
+}
+
+// moves to the next record, returns false once the records are over, the context is done or reading failed
+func (cur *Cursor) Next() bool {
+	cur.collection.layout.enter()
+	defer cur.collection.layout.leave()
+	cur.element = nil
+	if cur.err != nil {
+		return false
+	}
+	// the cursor may be closed by another goroutine
+	if cur.snapshot.check(cur.collection) != nil {
+		cur.offsets = nil
+		return false
+	}
+	if err := cur.ctx.Err(); err != nil {
+		return cur.fail(err)
+	}
+	m := cur.collection.Map
+	for len(cur.offsets) == 0 {
+		if cur.shard >= len(m.Shared) {
+			cur.Close()
+			return false
+		}
+		shard := m.Shared[cur.shard]
+		shard.RLock()
+		cur.offsets = shard.recordsAt(cur.snapshot.ts)
+		shard.RUnlock()
+		sort.Slice(cur.offsets, func(i, j int) bool { return cur.offsets[i].Start < cur.offsets[j].Start })
+		cur.shard++
+	}
+	shard := m.Shared[cur.shard-1]
+	// the snapshot keeps the data file in place
+	shard.fileMx.RLock()
+	data, err := m.ReadAtOffset(shard, &cur.offsets[0])
+	shard.fileMx.RUnlock()
+	cur.offsets = cur.offsets[1:]
+	if err != nil {
+		return cur.fail(err)
+	}
+	cur.element, err = cur.collection.DecodeElement(data)
+	if err != nil {
+		return cur.fail(err)
+	}
+	return true
+}
+
+func (cur *Cursor) fail(err error) bool {
+	cur.err = err
+	cur.element = nil
+	cur.Close()
+	return false
+}
+
+// returns the current record
+func (cur *Cursor) Element() *Element {
+	return cur.element
+}
+
+// returns the error that stopped the cursor, nil if the records are over
+func (cur *Cursor) Err() error {
+	return cur.err
+}
+
+// releases the cursor, it is closed by Next once the records are over. It can be called from another goroutine
+// while Next is running, Next returns false afterwards
+func (cur *Cursor) Close() {
+	cur.snapshot.Close()
+}
+
+// passes every alive record of the collection to fn until it returns an error or the context is done
+// (see Cursor), the error is returned
+func (c *Collection) Iterate(ctx context.Context, fn func(e *Element) error) error {
+	cur := c.Cursor(ctx)
+	defer cur.Close()
+	for cur.Next() {
+		err := fn(cur.Element())
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
@@ -10,15 +10,18 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	COLLECTION_DIR_NAME = "collections"
-	DB_VERSION          = 1
+	COLLECTION_DIR_NAME  = "collections"
+	TRANSACTION_DIR_NAME = "transactions"
+	DB_VERSION           = 2
 )
 
 type Database struct {
@@ -26,6 +29,16 @@ type Database struct {
 	Version         int                    `json:"version"`
 	collections     map[string]*Collection `json:"-"`
 	collectionMutex sync.RWMutex           `json:"-"`
+	durability      int                    `json:"-"`
+	compaction      *CompactorOptions      `json:"-"`
+
+	// commit records of the transactions (see Transaction)
+	txLog  *WriteAheadLog `json:"-"`
+	txPath string         `json:"-"`
+	txMx   sync.RWMutex   `json:"-"`
+
+	// orders the changes of all of the collections against the snapshots (see Snapshot)
+	clock *snapshotClock `json:"-"`
 }
 
 type CustomStructure interface {
@@ -42,15 +55,37 @@ func NewDatabase(name string) *Database {
 
 	ProfileSystemMemory()
 
-	return &Database{name, DB_VERSION, make(map[string]*Collection), sync.RWMutex{}}
+	return &Database{name, DB_VERSION, make(map[string]*Collection), sync.RWMutex{}, WAL_SYNC_ALWAYS, nil,
+		nil, TRANSACTION_DIR_NAME, sync.RWMutex{}, newSnapshotClock()}
+}
+
+// sets the durability mode of the write-ahead logs (WAL_SYNC_ALWAYS, WAL_SYNC_GROUP or WAL_SYNC_NONE)
+// for all of the existing and future collections
+func (db *Database) SetDurability(mode int) {
+	db.collectionMutex.Lock()
+	defer db.collectionMutex.Unlock()
+	db.durability = mode
+	for _, c := range db.collections {
+		c.Map.wal.SetMode(mode)
+	}
+	db.txLog.SetMode(mode)
 }
 
+// registers the payload type under the name, the records of the codecs other than gob refer to their types
+// by these names, so a renamed type can still be decoded
 func (db *Database) RegisterTypeName(name string, value CustomStructure) {
 	gob.RegisterName(name, value)
+	registerPayloadType(name, value)
 }
 
+// registers the payload type under the name of the type
 func (db *Database) RegisterType(value CustomStructure) {
 	gob.Register(value)
+	t := reflect.TypeOf(value)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	registerPayloadType(t.Name(), value)
 }
 
 // delete redundant data from all of the existing collections
@@ -91,6 +126,17 @@ func (db *Database) LocateDatabase(path string) (string, error) {
 
 // load the database
 func (db *Database) ScanAndLoadData(path string) error {
+	return db.scanAndLoad(path, false)
+}
+
+// Loads the database like ScanAndLoadData, but the damaged metadata of the collections
+// is rebuilt from their data files (see ConcurrentMapShared.Rebuild) instead of failing the load.
+// Repaired collections are synchronized with the hard drive right away
+func (db *Database) Repair(path string) error {
+	return db.scanAndLoad(path, true)
+}
+
+func (db *Database) scanAndLoad(path string, repair bool) error {
 	ln := len(path)
 	if ln > 0 && path[len(path)-1] != '\\' {
 		path += "\\"
@@ -131,124 +177,223 @@ func (db *Database) ScanAndLoadData(path string) error {
 		return err
 	}
 
+	// transactions committed since the last synchronization, their entries are replayed by the collections
+	committed, err := db.loadTransactionLog(path + TRANSACTION_DIR_NAME)
+	if err != nil {
+		return err
+	}
+
 	for _, c := range collections {
 		if c.IsDir() {
-			collectionPath := fullPath + "/" + c.Name()
-
-			collectionFiles, err := ioutil.ReadDir(collectionPath)
+			collection, repaired, err := db.loadCollection(fullPath+"/"+c.Name(), c.Name(), repair, committed)
 			if err != nil {
 				return err
 			}
-
-			cfLen := len(collectionFiles)
-			if cfLen < SHARD_COUNT {
-				return errors.New("collection has invalid amount of shards " + strconv.Itoa(cfLen) + ". Expected " + strconv.Itoa(SHARD_COUNT))
+			if repaired {
+				err = collection.Sync()
+				if err != nil {
+					return err
+				}
 			}
 
-			var collection *Collection
-			loaded := 0
-			files := make([]*os.File, SHARD_COUNT)
-			cm := NewConcurrentMap(collectionPath, files)
-			cNameExt := c.Name() + ".json.gzip"
-			mapIndexLoaded := false
-
-			for _, f := range collectionFiles {
-				fName := f.Name()
-				if strings.HasPrefix(fName, "shard_") {
-					// loading the shard main data
-					if strings.HasSuffix(fName, ".gobs") {
-						fi, err := os.OpenFile(collectionPath+"/"+fName, os.O_RDWR, os.ModePerm)
-						if err != nil {
-							return errors.New("collection (" + fName + ") shard (" + fName + ") is unavailable")
-						}
-						files[loaded] = fi
-						// loading the meta
-						fName := strings.TrimSuffix(fName, ".gobs") + "_meta.gob.gzip"
-						p := NewEncodedCompressedPackage(collectionPath + "/" + fName)
-						dec, err := p.LoadDecoder()
-						if err != nil {
-							return err
-						}
-						var shard ConcurrentMapShared
-						err = dec.Decode(&shard)
-						if err != nil {
-							return err
-						}
-						dec = nil
-						shard.file = fi
-						cm.Shared[shard.Id] = &shard
-						loaded++
-					}
-
-					// loading the map index
-				} else if f.Name() == "map.index" {
-					inFile, _ := os.Open(collectionPath + "/" + fName)
-					scanner := bufio.NewScanner(inFile)
-					scanner.Split(bufio.ScanLines)
-					// current map index
-					if scanner.Scan() {
-						num, err := strconv.ParseUint(scanner.Text(), 10, 64)
-						if err != nil {
-							return err
-						}
-						cm.SetCounterIndex(num)
-					}
-					// sync path
-					if scanner.Scan() {
-						cm.SyncDestination = path + "/" + scanner.Text()
-					}
-					inFile.Close()
-					mapIndexLoaded = true
-
-					// loading the collection's description
-				} else if f.Name() == cNameExt {
-					data, err := NewCompressedPackage(collectionPath+"/"+cNameExt, nil).Load()
-					if err != nil {
-						return err
-					}
-					collection = new(Collection)
-					err = json.Unmarshal(data, collection)
-					if err != nil {
-						return err
-					}
+			db.collectionMutex.Lock()
+			db.attachCollection(c.Name(), collection)
+			db.collectionMutex.Unlock()
+		}
+	}
+
+	return nil
+}
 
-				}
-			}
+// loads the current generation of the collection metadata (see Manifest) and replays its write-ahead log.
+// In the repair mode damaged metadata is rebuilt, the second value reports whether it has happened.
+// Entries of the transactions missing in committed are skipped
+func (db *Database) loadCollection(collectionPath, name string, repair bool, committed map[string]bool) (*Collection, bool, error) {
+	manifest, err := LoadManifest(collectionPath)
+	if err != nil {
+		if !repair {
+			return nil, false, errors.New("collection " + name + " manifest is corrupted due " + err.Error())
+		}
+		manifest = NewManifest(collectionPath)
+	}
 
-			if !mapIndexLoaded {
-				return errors.New("map index file was not loaded")
+	// loading the collection's description, it tells the layout of the data files
+	repaired := false
+	collection := new(Collection)
+	data, err := NewCompressedPackage(manifest.Path(CollectionDescriptorName(name)), nil).Load()
+	if os.IsNotExist(err) {
+		err = errors.New("collection description file missing")
+	} else if err == nil {
+		err = json.Unmarshal(data, collection)
+	}
+	if err != nil {
+		if !repair {
+			return nil, false, err
+		}
+		collection = nil
+		repaired = true
+	}
+	opts := CollectionOptions{}
+	if collection != nil {
+		opts = collection.Options
+	} else {
+		opts.ShardCount = countShardFiles(manifest)
+	}
+	opts, format, err := opts.resolve()
+	if err != nil {
+		return nil, false, errors.New("collection " + name + " descriptor is invalid due " + err.Error())
+	}
+
+	files := make([]*os.File, opts.ShardCount)
+	cm := NewConcurrentMap(collectionPath, files)
+	cm.setFormat(format)
+	for i := 0; i < opts.ShardCount; i++ {
+		// loading the shard main data
+		fName := ShardDataName(i)
+		fi, err := os.OpenFile(manifest.Path(fName), os.O_RDWR, os.ModePerm)
+		if err != nil {
+			return nil, false, errors.New("collection (" + name + ") shard (" + fName + ") is unavailable")
+		}
+		files[i] = fi
+		// loading the meta
+		shard, err := loadShardMeta(manifest.Path(ShardMetaName(i)), i)
+		if err != nil {
+			if !repair {
+				return nil, false, err
 			}
-			if collection == nil {
-				return errors.New("collection description file missing")
+			log.Println("WARNING! Collection", name, "shard", i, "metadata is damaged (", err.Error(), "), rebuilding it from the data file")
+			shard = NewConcurrentMapShared(collectionPath, i, fi)
+			shard.format = format
+			_, err = shard.Rebuild()
+			if err != nil {
+				return nil, false, err
 			}
+			repaired = true
+		}
+		shard.file = fi
+		shard.format = format
+		shard.SyncDestination = collectionPath
+		shard.relink()
+		cm.Shared[i] = shard
+	}
 
-			collection.Map = cm
-			collection.Cache = NewCollectionCache()
+	// loading the map index
+	err = loadMapIndex(manifest.Path(MAP_INDEX_NAME), cm)
+	if err != nil {
+		if !repair {
+			return nil, false, err
+		}
+		repaired = true
+	}
 
-			db.collectionMutex.Lock()
-			db.collections[c.Name()] = collection
-			db.collectionMutex.Unlock()
+	if collection == nil {
+		cm.placement = cm.detectPlacement()
+		opts.Placement = cm.placement
+		collection = NewCollectionWithOptions(collectionPath, name, cm, make(map[string]*int), opts)
+	}
+	collection.Options = opts
+	cm.placement = opts.Placement
+	collection.Map = cm
+	collection.useCache(collection.Options.Cache)
+	collection.SyncDestination = collectionPath
+	collection.manifest = manifest
+	if repaired {
+		collection.rebuildDestinations()
+	}
 
-			if loaded < SHARD_COUNT {
-				return errors.New("collection " + c.Name() + " files are corrupted")
-			}
+	// bring the collection up to date with the acknowledged changes that were not synchronized
+	// the numbering continues above the changes saved in the shards, otherwise the new entries would be skipped on replay
+	seq := uint64(0)
+	for _, shard := range cm.Shared {
+		if shard.Seq > seq {
+			seq = shard.Seq
+		}
+	}
+	cm.wal, err = OpenWriteAheadLog(collectionPath, db.durability, seq, func(e *walEntry) error {
+		if e.TxId != "" && !committed[e.TxId] {
+			return nil
+		}
+		return collection.replay(e)
+	})
+	if err != nil {
+		return nil, false, errors.New("collection " + name + " write-ahead log replay failed due " + err.Error())
+	}
+	collection.ObjectsCounter = cm.CountAlive()
+	cm.rebuildUniques()
+
+	// files of an unfinished synchronization are rolled back
+	return collection, repaired, manifest.RemoveStale()
+}
+
+// counts the data files of a collection without a descriptor
+func countShardFiles(manifest *Manifest) int {
+	n := 0
+	for {
+		_, err := os.Stat(manifest.Path(ShardDataName(n)))
+		if err != nil {
+			return n
 		}
+		n++
 	}
+}
 
+func loadShardMeta(name string, id int) (*ConcurrentMapShared, error) {
+	p := NewEncodedCompressedPackage(name)
+	dec, err := p.LoadDecoder()
+	if err != nil {
+		return nil, err
+	}
+	shard := new(ConcurrentMapShared)
+	err = dec.Decode(shard)
+	if err != nil {
+		return nil, err
+	}
+	if shard.Id != id {
+		return nil, errors.New("shard metadata belongs to another shard")
+	}
+	return shard, nil
+}
+
+func loadMapIndex(name string, cm *ConcurrentMap) error {
+	inFile, err := os.Open(name)
+	if err != nil {
+		return errors.New("map index file was not loaded")
+	}
+	defer inFile.Close()
+	scanner := bufio.NewScanner(inFile)
+	scanner.Split(bufio.ScanLines)
+	// current map index
+	if scanner.Scan() {
+		num, err := strconv.ParseUint(scanner.Text(), 10, 64)
+		if err != nil {
+			return err
+		}
+		return cm.SetCounterIndex(num)
+	}
 	return nil
 }
 
 // synchronizes the database with the hard drive
 func (db *Database) Sync() error {
+	// commit records of the transactions finished before this point are not needed once every collection is synchronized
+	db.txMx.Lock()
+	txGen, err := db.txLog.Rotate()
+	db.txMx.Unlock()
+	if err != nil {
+		return err
+	}
+
 	db.collectionMutex.RLock()
 	wg := sync.WaitGroup{}
 	wg.Add(len(db.collections))
+	failed := int32(0)
 	for _, c := range db.collections {
 		go func(cl *Collection) {
 			log.Println("Synchronizing " + cl.Name)
 			err := cl.Sync()
 			if err != nil {
 				log.Println("Collection "+cl.Name+" syncronization failed:", err.Error())
+				atomic.StoreInt32(&failed, 1)
 			}
 			wg.Done()
 		}(c)
@@ -257,12 +402,23 @@ func (db *Database) Sync() error {
 
 	wg.Wait()
 
+	if atomic.LoadInt32(&failed) == 0 {
+		err = db.txLog.Remove(txGen)
+		if err != nil {
+			return err
+		}
+	}
+	return db.saveHeader()
+}
+
+// writes the header file (.shardb)
+func (db *Database) saveHeader() error {
 	data, err := json.Marshal(db)
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(db.Name+".shardb", data, os.ModePerm)
+	return WriteBytesAtomic(db.Name+".shardb", data)
 }
 
 func (db *Database) GetCollectionsCount() int {
@@ -299,30 +455,79 @@ func (db *Database) GetRandomCollection() (*Collection, error) {
 	return nil, errors.New("could not pick a collection")
 }
 
-func (db *Database) AddCollection(name string) (*Collection, error) {
+// creates a collection, the options are the defaults if none are given
+func (db *Database) AddCollection(name string, opts ...CollectionOptions) (*Collection, error) {
+	options := CollectionOptions{}
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	return db.AddCollectionWithOptions(name, options)
+}
+
+// creates a collection with the given layout of the data files, the options are kept in its descriptor
+func (db *Database) AddCollectionWithOptions(name string, opts CollectionOptions) (*Collection, error) {
+	opts, format, err := opts.resolve()
+	if err != nil {
+		return nil, err
+	}
 	if db.GetCollection(name) != nil {
 		return nil, errors.New("collection is already exist")
 	}
 
-	files := make([]*os.File, SHARD_COUNT)
+	files := make([]*os.File, opts.ShardCount)
 	path := COLLECTION_DIR_NAME + "/" + name
 	os.MkdirAll(path, os.ModePerm)
-	for i := 0; i < SHARD_COUNT; i++ {
-		f, err := os.Create(path + "/shard_" + strconv.Itoa(i) + ".gobs")
+	for i := 0; i < opts.ShardCount; i++ {
+		f, err := os.Create(path + "/" + ShardDataName(i))
 		if err != nil {
 			return nil, errors.New("failed to create a shard")
 		}
 		files[i] = f
 	}
 
-	c := NewCollection(path, name, NewConcurrentMap(path, files), make(map[string]*int))
+	err = db.startTransactionLog()
+	if err != nil {
+		return nil, err
+	}
+	cm := NewConcurrentMap(path, files)
+	cm.placement = opts.Placement
+	cm.setFormat(format)
+	// nothing to replay for a brand new collection, leftovers of the previous one are discarded
+	wal, err := OpenWriteAheadLog(path, db.durability, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	cm.wal = wal
+
+	c := NewCollectionWithOptions(path, name, cm, make(map[string]*int), opts)
+	// the collection must be loadable right away, otherwise its write-ahead log could not be replayed
+	err = c.Sync()
+	if err != nil {
+		return nil, err
+	}
+	err = db.saveHeader()
+	if err != nil {
+		return nil, err
+	}
 	db.collectionMutex.Lock()
-	db.collections[name] = c
+	db.attachCollection(name, c)
 	db.collectionMutex.Unlock()
 
 	return c, nil
 }
 
+// registers the collection and starts its background compaction if it is enabled, the lock must be held
+func (db *Database) attachCollection(name string, c *Collection) {
+	if old, ok := db.collections[name]; ok && old != c {
+		old.StopCompaction()
+	}
+	c.Map.clock = db.clock
+	db.collections[name] = c
+	if db.compaction != nil {
+		c.StartCompaction(*db.compaction)
+	}
+}
+
 func (db *Database) GetCollection(name string) *Collection {
 	db.collectionMutex.RLock()
 	c := db.collections[name]
@@ -330,8 +535,39 @@ func (db *Database) GetCollection(name string) *Collection {
 	return c
 }
 
+// stops the background compaction, closes the write-ahead logs and the data files of the collections
+// and the log of the transactions. The database can not be used afterwards, the changes made since the last
+// Sync are replayed by the next ScanAndLoadData
+func (db *Database) Close() error {
+	db.collectionMutex.Lock()
+	defer db.collectionMutex.Unlock()
+	var err error
+	keep := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	for _, c := range db.collections {
+		c.StopCompaction()
+		keep(c.Map.wal.Close())
+		for _, shard := range c.Map.Shared {
+			shard.fileMx.Lock()
+			keep(shard.file.Close())
+			shard.fileMx.Unlock()
+		}
+	}
+	db.txMx.Lock()
+	keep(db.txLog.Close())
+	db.txMx.Unlock()
+	return err
+}
+
 func (db *Database) DropCollection(name string) {
 	db.collectionMutex.Lock()
+	if c, ok := db.collections[name]; ok {
+		c.StopCompaction()
+		c.Map.wal.Close()
+	}
 	delete(db.collections, name)
 	db.collectionMutex.Unlock()
 }
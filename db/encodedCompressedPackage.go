@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"os"
 	"compress/gzip"
+	"io"
 	"io/ioutil"
 )
 
@@ -26,6 +27,7 @@ func (p *EncodedCompressedPackage) SetCompressionLevel(level int) {
 	p.compressionLevel = level
 }
 
+// the file is replaced atomically, see WriteFileAtomic
 func (p *EncodedCompressedPackage) Save() error {
 	var data bytes.Buffer
 
@@ -35,17 +37,14 @@ func (p *EncodedCompressedPackage) Save() error {
 		return err
 	}
 
-	f, err := os.Create(p.name)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	gzipw, _ := gzip.NewWriterLevel(f, p.compressionLevel)
-	defer gzipw.Close()
-	_, err = gzipw.Write(data.Bytes())
-
-	return err
+	return WriteFileAtomic(p.name, func(w io.Writer) error {
+		gzipw, _ := gzip.NewWriterLevel(w, p.compressionLevel)
+		_, err := gzipw.Write(data.Bytes())
+		if err != nil {
+			return err
+		}
+		return gzipw.Close()
+	})
 }
 
 func (p *EncodedCompressedPackage) LoadDecoder() (*gob.Decoder, error) {
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const MANIFEST_NAME = "MANIFEST"
+
+// The manifest records which generation of every metadata file of a collection is current.
+// Files are written as <name>.<generation> and become visible only when the manifest is committed,
+// so a half-finished synchronization is rolled back on load. Generation 0 stands for the plain <name>
+type Manifest struct {
+	Generation uint64            `json:"gen"`
+	Files      map[string]uint64 `json:"files"`
+
+	path string
+	// generations reserved by Next that are neither committed nor released, their files are being written
+	pending map[uint64]bool
+	mx      sync.Mutex
+}
+
+func NewManifest(path string) *Manifest {
+	return &Manifest{Files: make(map[string]uint64), path: path, pending: make(map[uint64]bool)}
+}
+
+// loads the manifest of the collection, a collection without one uses the plain file names
+func LoadManifest(path string) (*Manifest, error) {
+	m := NewManifest(path)
+	data, err := ioutil.ReadFile(path + "/" + MANIFEST_NAME)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]uint64)
+	}
+	return m, nil
+}
+
+func generationName(name string, gen uint64) string {
+	if gen == 0 {
+		return name
+	}
+	return name + "." + strconv.FormatUint(gen, 10)
+}
+
+// returns the full path of the current generation of the file
+func (m *Manifest) Path(name string) string {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.path + "/" + generationName(name, m.Files[name])
+}
+
+// returns the full path of the file in the given generation
+func (m *Manifest) PathOf(name string, gen uint64) string {
+	return m.path + "/" + generationName(name, gen)
+}
+
+// reserves the next generation, files written under it stay invisible until Commit.
+// They are not removed by RemoveStale until the generation is committed or released
+func (m *Manifest) Next() uint64 {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.Generation++
+	m.pending[m.Generation] = true
+	return m.Generation
+}
+
+// gives up the generation if it has not been committed, its files are removed by the next RemoveStale
+func (m *Manifest) Release(gen uint64) {
+	m.mx.Lock()
+	delete(m.pending, gen)
+	m.mx.Unlock()
+}
+
+// atomically switches the files to the given generation, previous versions are left for RemoveStale
+func (m *Manifest) Commit(gen uint64, names []string) error {
+	return m.Replace(gen, names, nil)
+}
+
+// same as Commit, but the dropped files are no longer a part of the collection (see Collection.Reshard).
+// Their current versions have to be removed by the caller
+func (m *Manifest) Replace(gen uint64, names []string, dropped []string) error {
+	m.mx.Lock()
+	previous := make(map[string]uint64, len(names)+len(dropped))
+	for _, name := range dropped {
+		if g, ok := m.Files[name]; ok {
+			previous[name] = g
+			delete(m.Files, name)
+		}
+	}
+	for _, name := range names {
+		previous[name] = m.Files[name]
+		m.Files[name] = gen
+	}
+	data, err := json.Marshal(m)
+	if err == nil {
+		err = WriteBytesAtomic(m.path+"/"+MANIFEST_NAME, data)
+	}
+	if err != nil {
+		// the manifest on the drive still refers to the previous generation
+		for name, g := range previous {
+			m.Files[name] = g
+		}
+		m.mx.Unlock()
+		return err
+	}
+	delete(m.pending, gen)
+	m.mx.Unlock()
+	return nil
+}
+
+// removes temporary files and generations of the files that are not current
+// (either superseded or left by a synchronization that has never been committed),
+// the files of the pending generations are being written and are left alone
+func (m *Manifest) RemoveStale() error {
+	files, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		return err
+	}
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, TEMP_FILE_SUFFIX) {
+			os.Remove(m.path + "/" + name)
+			continue
+		}
+		logical, gen := name, uint64(0)
+		if pos := strings.LastIndex(name, "."); pos > 0 {
+			if n, err := strconv.ParseUint(name[pos+1:], 10, 64); err == nil {
+				logical, gen = name[:pos], n
+			}
+		}
+		if m.pending[gen] {
+			continue
+		}
+		current, ok := m.Files[logical]
+		if !ok {
+			// plain files the manifest does not know about (e.g. data files) are left alone
+			if gen == 0 {
+				continue
+			}
+		} else if current == gen {
+			continue
+		}
+		err = os.Remove(m.path + "/" + name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
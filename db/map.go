@@ -5,16 +5,24 @@ package db
 import (
 	"errors"
 	"github.com/rs/xid"
-	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 )
 
 // Every collection will be split along %SHARD_COUNT% files
 var SHARD_COUNT = 32
 
+// Record placement modes of a collection
+const (
+	// records are spread over the shards in turns, their keys are tracked by Collection.ShardDestinations
+	PLACEMENT_ROUND_ROBIN = iota
+	// the shard is derived from the id of the record, so no destinations have to be tracked
+	PLACEMENT_HASH
+)
+
 // A "thread" safe map of type string:Anything.
 // To avoid lock bottlenecks this map is dived to several (SHARD_COUNT) map shards.
 
@@ -24,48 +32,51 @@ type ConcurrentMap struct {
 	counter         uint64
 	counterMx       sync.Mutex
 	SyncDestination string
+
+	wal       *WriteAheadLog
+	placement int
+
+	// unique key -> id of the record that holds it, across all of the shards
+	uniques  map[string]string
+	uniqueMx sync.Mutex
+
+	// shared by all of the collections of the database (see Snapshot)
+	clock *snapshotClock
+	// receives the keys of the changed records under the shard lock (see queryCache)
+	changed func(keys []string)
+	format  *recordFormat
 }
 
 type ShardOffset struct {
 	Start   int64 `json:"s"`
 	Length  int   `json:"l"`
 	Deleted bool  `json:"!,omitempty"`
+
+	// id of the record, restored from the "id" key on load
+	id string
+	// time of the change that has written the record (see snapshotClock), 0 for the loaded records
+	created uint64
 }
 
 func (cm *ConcurrentMap) GetRandomShard() *ConcurrentMapShared {
 	return cm.Shared[rand.Intn(len(cm.Shared))]
 }
 
-// Flushes all data to the drive and then reopens the file
+// Flushes all data to the drive
 func (cm *ConcurrentMap) Flush() error {
 	for _, shard := range cm.Shared {
-		shard.Lock()
-		shard.file.Close()
-		f, err := os.OpenFile(shard.SyncDestination+"/shard_"+strconv.Itoa(shard.Id)+".gobs", os.O_RDWR, os.ModePerm)
+		shard.RLock()
+		err := shard.file.Sync()
+		shard.RUnlock()
 		if err != nil {
-			shard.Unlock()
 			return err
 		}
-		shard.file = f
-		shard.Unlock()
 	}
 	return nil
 }
 
-// deletes redundant data from the drive
-// n - total sized of the data that has been removed
-func (cm *ConcurrentMap) OptimizeShards() (n int64, err error) {
-	for _, shard := range cm.Shared {
-		n, err = shard.Optimize()
-		if err != nil {
-			return n, err
-		}
-	}
-	return
-}
-
 func (cm *ConcurrentMap) SetCounterIndex(value uint64) error {
-	if value >= uint64(SHARD_COUNT) || value < 0 {
+	if value >= uint64(len(cm.Shared)) {
 		return errors.New("invalid value")
 	}
 	cm.counterMx.Lock()
@@ -74,34 +85,64 @@ func (cm *ConcurrentMap) SetCounterIndex(value uint64) error {
 	return nil
 }
 
-// synchronizes database with the drive
-func (cm *ConcurrentMap) Sync() (err error) {
+const MAP_INDEX_NAME = "map.index"
+
+// synchronizes database with the drive, the metadata is written under the given generation (see Manifest).
+// Returns names of the written files
+func (cm *ConcurrentMap) Sync(gen uint64) (names []string, err error) {
+	names = make([]string, 0, len(cm.Shared)+1)
 	for _, shard := range cm.Shared {
-		err = shard.Sync()
+		err = shard.Sync(gen)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		names = append(names, ShardMetaName(shard.Id))
 	}
 	cm.counterMx.Lock()
-	err = ioutil.WriteFile(cm.SyncDestination+"/map.index",
-		[]byte(strconv.FormatUint(cm.counter, 10)+"\n"+cm.SyncDestination), os.ModePerm)
+	data := []byte(strconv.FormatUint(cm.counter, 10) + "\n" + cm.SyncDestination)
 	cm.counterMx.Unlock()
-	return err
+	err = WriteBytesAtomic(cm.SyncDestination+"/"+generationName(MAP_INDEX_NAME, gen), data)
+	if err != nil {
+		return nil, err
+	}
+	return append(names, MAP_INDEX_NAME), nil
 }
 
-// Creates a new concurrent map.
+// Creates a new concurrent map with a shard for every data file
 func NewConcurrentMap(syncDest string, files []*os.File) *ConcurrentMap {
-	m := &ConcurrentMap{make([]*ConcurrentMapShared, SHARD_COUNT),
-		0, sync.Mutex{}, syncDest}
-	for i := 0; i < SHARD_COUNT; i++ {
+	m := &ConcurrentMap{make([]*ConcurrentMapShared, len(files)),
+		0, sync.Mutex{}, syncDest, nil, PLACEMENT_ROUND_ROBIN, make(map[string]string), sync.Mutex{}, newSnapshotClock(), nil,
+		&recordFormat{CODEC_GOB, gobCodec{}, COMPRESSION_NONE}}
+	for i := range files {
 		m.Shared[i] = NewConcurrentMapShared(syncDest, i, files[i])
+		m.Shared[i].format = m.format
 	}
 	return m
 }
 
+// sets the format of the records of the map and its shards
+func (m *ConcurrentMap) setFormat(f *recordFormat) {
+	m.format = f
+	for _, shard := range m.Shared {
+		shard.format = f
+	}
+}
+
 // Returns shard under given key
 func (m *ConcurrentMap) GetShard(key string) *ConcurrentMapShared {
-	return m.Shared[uint(fnv32(key))%uint(SHARD_COUNT)]
+	return m.Shared[uint(fnv32(key))%uint(len(m.Shared))]
+}
+
+// returns the shard of the record under the "id" or unique key in the PLACEMENT_HASH mode
+func (m *ConcurrentMap) locate(key string) (*ConcurrentMapShared, bool) {
+	if strings.HasPrefix(key, "id:") {
+		return m.GetShard(key[3:]), true
+	}
+	id, ok := m.uniqueOwner(key)
+	if !ok {
+		return nil, false
+	}
+	return m.GetShard(id), true
 }
 
 func (m *ConcurrentMap) GetNextShard() *ConcurrentMapShared {
@@ -109,58 +150,84 @@ func (m *ConcurrentMap) GetNextShard() *ConcurrentMapShared {
 	defer m.counterMx.Unlock()
 
 	m.counter++
-	if m.counter >= 32 {
+	if m.counter >= uint64(len(m.Shared)) {
 		m.counter = 0
 	}
 	return m.Shared[m.counter]
 }
 
+// reads the record and returns its payload, the checksum of the record is validated
 func (m *ConcurrentMap) ReadAtOffset(shard *ConcurrentMapShared, offset *ShardOffset) ([]byte, error) {
 	data := make([]byte, offset.Length)
 	_, err := shard.file.ReadAt(data, offset.Start)
-	return data, err
+	if err != nil {
+		return nil, err
+	}
+	return DecodeRecord(data)
+}
+
+// writes the records flipped under the keys to the write-ahead log, must be called under the shard lock.
+// Records are referred by their "id" keys, since the slots of the regular indexes are not stable
+func (m *ConcurrentMap) logKeys(shard *ConcurrentMapShared, op int, keys []string) (uint64, error) {
+	ids := make([]string, 0, len(keys))
+	items := make(map[*ShardOffset]bool, len(keys))
+	for _, key := range keys {
+		if item, ok := shard.Items[key]; ok && item.id != "" {
+			ids = append(ids, "id:"+item.id)
+			items[item] = true
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if op == walOpRestore && m.changed != nil {
+		// a restored record may belong to the results of any of its keys
+		m.notify(shard.keysOfItems(items))
+	} else {
+		m.notify(ids)
+	}
+	seq, err := m.wal.Append(&walEntry{Op: op, Shard: shard.Id, Keys: ids})
+	if err != nil {
+		return 0, err
+	}
+	if seq > 0 {
+		shard.Seq = seq
+	}
+	return seq, nil
 }
 
-func (m *ConcurrentMap) RestoreByKey(key, value string, limit int) int {
+func (m *ConcurrentMap) RestoreByKey(key, value string, limit int) (int, error) {
 	counter := 0
-	for n := 0; n < SHARD_COUNT; n++ {
-		shard := m.Shared[n]
-		shard.Lock()
-		kv := key + ":" + value
-		en := ":" + kv
-		length := shard.GetCapacityKey(kv)
-		tempKey := ""
-		for i := length - 1; i >= 0; i-- {
-			tempKey = strconv.Itoa(i) + en
-			if item, ok := shard.Items[tempKey]; ok {
-				if !item.Deleted {
-					continue
-				}
-				item.Deleted = false
+	lastSeq := uint64(0)
+	kv := key + ":" + value
+	for _, shard := range m.Shared {
+		st := m.lockShard(shard)
+		restored := make([]string, 0)
+		shard.eachSlot(kv, func(slotKey string, item *ShardOffset) bool {
+			if item.Deleted {
+				shard.flip(item, false, st)
+				restored = append(restored, slotKey)
 				counter++
-				if counter == limit {
-					shard.Unlock()
-					return limit
-				}
-			} else {
-				break
 			}
-			i++
+			return counter < limit
+		})
+		seq, err := m.logKeys(shard, walOpRestore, restored)
+		m.unlockShard(shard)
+		if err != nil {
+			return counter, err
+		}
+		if seq > 0 {
+			lastSeq = seq
+		}
+		if counter == limit {
+			break
 		}
-		shard.SetCapacityKey(kv, length+counter)
-		shard.Unlock()
 	}
-	return counter
+	return counter, m.wal.Commit(lastSeq)
 }
 
 func (m *ConcurrentMap) RestoreByUniqueKey(shard *ConcurrentMapShared, key, value string) error {
-	shard.Lock()
-	defer shard.Unlock()
-	if item, ok := shard.Items[key+":"+value]; ok {
-		item.Deleted = false
-		return nil
-	}
-	return errors.New("object footprint was already evicted")
+	return m.flipUniqueKey(shard, key+":"+value, walOpRestore)
 }
 
 func (m *ConcurrentMap) DeleteById(shard *ConcurrentMapShared, id string) error {
@@ -168,182 +235,246 @@ func (m *ConcurrentMap) DeleteById(shard *ConcurrentMapShared, id string) error
 }
 
 func (m *ConcurrentMap) DeleteByUniqueKey(shard *ConcurrentMapShared, key, value string) error {
-	shard.Lock()
-	defer shard.Unlock()
-	if item, ok := shard.Items[key+":"+value]; ok {
-		item.Deleted = true
-		return nil
+	return m.flipUniqueKey(shard, key+":"+value, walOpDelete)
+}
+
+// marks the record under the unique key as deleted (walOpDelete) or alive (walOpRestore)
+func (m *ConcurrentMap) flipUniqueKey(shard *ConcurrentMapShared, fullKey string, op int) error {
+	st := m.lockShard(shard)
+	item, ok := shard.Items[fullKey]
+	if !ok {
+		m.unlockShard(shard)
+		if op == walOpRestore {
+			return errors.New("object footprint was already evicted")
+		}
+		return errors.New("object under specified unique key was not found")
 	}
-	return errors.New("object under specified unique key was not found")
+	shard.flip(item, op == walOpDelete, st)
+	seq, err := m.logKeys(shard, op, []string{fullKey})
+	m.unlockShard(shard)
+	if err != nil {
+		return err
+	}
+	return m.wal.Commit(seq)
 }
 
-func (m *ConcurrentMap) DeleteByKey(key, value string, limit int) (deletedDests []string) {
+func (m *ConcurrentMap) DeleteByKey(key, value string, limit int) (deletedDests []string, err error) {
 	counter := 0
+	lastSeq := uint64(0)
+	kv := key + ":" + value
 	deletedDests = make([]string, 0)
-	for n := 0; n < SHARD_COUNT; n++ {
-		shard := m.Shared[n]
-		shard.Lock()
-		kv := key + ":" + value
-		en := ":" + kv
-		length := shard.GetCapacityKey(kv)
-		tempKey := ""
-		for i := length - 1; i >= 0; i-- {
-			tempKey = strconv.Itoa(i) + en
-			if item, ok := shard.Items[tempKey]; ok {
-				if item.Deleted {
-					continue
-				}
-				item.Deleted = true
-				deletedDests = append(deletedDests, tempKey)
+	for _, shard := range m.Shared {
+		st := m.lockShard(shard)
+		deleted := make([]string, 0)
+		shard.eachSlot(kv, func(slotKey string, item *ShardOffset) bool {
+			if !item.Deleted {
+				shard.flip(item, true, st)
+				deleted = append(deleted, slotKey)
 				counter++
-				if counter == limit {
-					shard.Unlock()
-					return deletedDests
-				}
-			} else {
-				break
 			}
-			i++
+			return counter < limit
+		})
+		seq, err := m.logKeys(shard, walOpDelete, deleted)
+		m.unlockShard(shard)
+		if err != nil {
+			return deletedDests, err
+		}
+		if seq > 0 {
+			lastSeq = seq
+		}
+		deletedDests = append(deletedDests, deleted...)
+		if counter == limit {
+			break
 		}
-		shard.Unlock()
 	}
-	return deletedDests
+	return deletedDests, m.wal.Commit(lastSeq)
 }
 
 func (m *ConcurrentMap) FindById(shard *ConcurrentMapShared, id string) ([]byte, error) {
 	return m.FindByUniqueKey(shard, "id", id)
 }
 
+// the shard lock is held only while the record is looked up, it is read from the drive without the lock
 func (m *ConcurrentMap) FindByUniqueKey(shard *ConcurrentMapShared, key, value string) ([]byte, error) {
-	shard.RLock()
-	defer shard.RUnlock()
+	return m.findUniqueAt(shard, key+":"+value, latest)
+}
 
-	if item, ok := shard.Items[key+":"+value]; ok {
-		return m.ReadAtOffset(shard, item)
+func (m *ConcurrentMap) FindByKeyInShard(shard *ConcurrentMapShared, key, value string, limit int) ([][]byte, error) {
+	return m.findInShardAt(shard, key+":"+value, limit, latest, make([][]byte, 0, limit))
+}
+
+// reads up to limit alive records of the regular index, shards are visited one by one and
+// the lock of a shard is held only while its records are looked up
+func (m *ConcurrentMap) FindByKey(key, value string, limit int) ([][]byte, error) {
+	return m.findByKeyAt(key+":"+value, limit, latest)
+}
+
+func (m *ConcurrentMap) Set(indexData []*FullDataIndex, value interface{}) (map[string]*int, error) {
+	return m.set(xid.New().String(), indexData, value)
+}
+
+func (m *ConcurrentMap) set(idStr string, indexData []*FullDataIndex, value interface{}) (map[string]*int, error) {
+	// marshal the payload
+	elem := Element{idStr, value, 1}
+	encodedData, err := m.format.encode(elem)
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := m.reserveUniques(idStr, indexData)
+	if err != nil {
+		return nil, err
+	}
+	shard := m.placeShard(idStr)
+	st := m.lockShard(shard)
+	ch, err := m.writeLocked(shard, idStr, indexData, encodedData, "", st)
+	m.unlockShard(shard)
+	if err != nil {
+		m.releaseUniques(idStr, reserved)
+		return nil, err
 	}
-	return nil, errors.New("not found")
+	return destinations(shard, ch.keys), m.wal.Commit(ch.seq)
 }
 
-func (m *ConcurrentMap) FindByKeyInShard(shard *ConcurrentMapShared, key, value string, limit int) ([][]byte, error) {
-	shard.RLock()
-	defer shard.RUnlock()
+// returns the shard a new record is going to be written into
+func (m *ConcurrentMap) placeShard(id string) *ConcurrentMapShared {
+	if m.placement == PLACEMENT_HASH {
+		return m.GetShard(id)
+	}
+	return m.GetNextShard()
+}
 
-	kv := ":" + key + ":" + value
-	results := make([][]byte, 0, limit)
-	i := 0
-	for {
-		if item, ok := shard.Items[strconv.Itoa(i)+kv]; ok {
-			if item.Deleted {
-				continue
-			}
-			data, err := m.ReadAtOffset(shard, item)
-			if err != nil {
-				return nil, err
-			}
-			results = append(results, data)
-			if len(results) == limit {
-				return results, nil
-			}
-		} else {
-			break
-		}
-		i++
+// writes a new record into the shard, the caller must hold the shard lock (see lockShard)
+func (m *ConcurrentMap) writeLocked(shard *ConcurrentMapShared, idStr string, indexData []*FullDataIndex, encodedData []byte, txId string, st stamp) (*shardChange, error) {
+	// collect the keys of the record before anything is written
+	keys, err := shard.recordKeys(idStr, indexData, true)
+	if err != nil {
+		return nil, err
 	}
-	return results, nil
+	// write encoded data to the end of the file
+	offset, record, err := shard.appendRecord(encodedData)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := m.wal.Append(&walEntry{Op: walOpWrite, Shard: shard.Id, Offset: offset, Data: record, Keys: keys, TxId: txId})
+	if err != nil {
+		return nil, err
+	}
+	if seq > 0 {
+		shard.Seq = seq
+	}
+	offset.created = st.ts
+	indexes := shard.indexStateOf(keys)
+	shard.insert(&offset, keys)
+	m.notify(keys)
+	return &shardChange{shard: shard, op: walOpWrite, offset: &offset, keys: keys, seq: seq, version: 1, indexes: indexes, at: st.ts}, nil
 }
 
-func (m *ConcurrentMap) FindByKey(key, value string, limit int) ([][]byte, error) {
-	results := make([][]byte, 0, limit)
-	kv := ":" + key + ":" + value
-	for n := 0; n < SHARD_COUNT; n++ {
-		shard := m.Shared[n]
-		shard.Lock()
-		i := 0
-		for {
-			if item, ok := shard.Items[strconv.Itoa(i)+kv]; ok {
-				if item.Deleted {
-					continue
-				}
-				data, err := m.ReadAtOffset(shard, item)
-				if err != nil {
-					shard.Unlock()
-					return nil, err
-				}
-				results = append(results, data)
-				if len(results) == limit {
-					shard.Unlock()
-					return results, nil
-				}
-			} else {
-				break
-			}
-			i++
-		}
-		shard.Unlock()
+// rewrites the payload of the alive record, the id of the record is kept.
+// Returns the destinations of the new keys and the keys the record is no longer stored under
+func (m *ConcurrentMap) Update(shard *ConcurrentMapShared, id string, indexData []*FullDataIndex, value interface{}) (map[string]*int, []string, error) {
+	destMap, removed, _, err := m.update(shard, id, ANY_VERSION, indexData, value)
+	return destMap, removed, err
+}
+
+// same as Update, but the record is rewritten only if its version is the expected one (see ErrVersionConflict).
+// Returns the new version of the record as well
+func (m *ConcurrentMap) CompareAndSwap(shard *ConcurrentMapShared, id string, expected uint64, indexData []*FullDataIndex, value interface{}) (map[string]*int, []string, uint64, error) {
+	return m.update(shard, id, expected, indexData, value)
+}
+
+func (m *ConcurrentMap) update(shard *ConcurrentMapShared, id string, expected uint64, indexData []*FullDataIndex, value interface{}) (map[string]*int, []string, uint64, error) {
+	reserved, err := m.reserveUniques(id, indexData)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	st := m.lockShard(shard)
+	ch, err := m.updateLocked(shard, id, expected, indexData, value, "", st)
+	m.unlockShard(shard)
+	if err != nil {
+		m.releaseUniques(id, reserved)
+		return nil, nil, 0, err
 	}
-	return results, nil
+	// the old values of the unique indexes are free now
+	m.releaseUniques(id, ch.removed)
+	return destinations(shard, ch.keys), ch.removed, ch.version, m.wal.Commit(ch.seq)
 }
 
-func (m *ConcurrentMap) Set(indexData []*FullDataIndex, value interface{}) (map[string]*int, error) {
-	idStr := xid.New().String()
-	// marshal the payload
-	elem := Element{idStr, value}
-	encodedData, err := EncodeGob(elem)
+// rewrites the alive record of the shard, the caller must hold the shard lock (see lockShard)
+func (m *ConcurrentMap) updateLocked(shard *ConcurrentMapShared, id string, expected uint64, indexData []*FullDataIndex, value interface{}, txId string, st stamp) (*shardChange, error) {
+	old, ok := shard.Items["id:"+id]
+	if !ok || old.Deleted {
+		return nil, errors.New("object under specified id was not found")
+	}
+	e, err := shard.readElement(old)
 	if err != nil {
 		return nil, err
 	}
-	// get map shard
-	shard := m.GetNextShard()
-	shard.Lock()
-	defer shard.Unlock()
-	// write to the end of the file
-	ret, err := shard.file.Seek(0, 2)
+	if expected != ANY_VERSION && e.Version != expected {
+		return nil, &ErrVersionConflict{id, expected, e.Version}
+	}
+	oldKeys, err := shard.keysOf(e, old)
 	if err != nil {
 		return nil, err
 	}
-	// write encoded data to the file
-	n := 0
-	n, err = shard.file.Write(encodedData)
+	// the version is taken under the lock, so the payload is encoded here as well
+	encodedData, err := m.format.encode(Element{id, value, e.Version + 1})
+	if err != nil {
+		return nil, err
+	}
+	keys, removed := shard.updatedKeys(id, oldKeys, indexData)
+	// the new version is appended, the old one is left for the compaction
+	offset, record, err := shard.appendRecord(encodedData)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := m.wal.Append(&walEntry{Op: walOpUpdate, Shard: shard.Id, Offset: offset, Data: record, Keys: keys, Removed: removed, TxId: txId})
+	if err != nil {
+		return nil, err
+	}
+	if seq > 0 {
+		shard.Seq = seq
+	}
+	// the snapshots taken before keep reading the old version under its keys
+	shard.retire(old, oldKeys, st)
+	offset.created = st.ts
+	indexes := shard.indexStateOf(keys)
+	shard.replace(old, &offset, removed, keys)
+	m.notify(append(append([]string{}, oldKeys...), keys...))
+	return &shardChange{shard, walOpUpdate, old, oldKeys, &offset, keys, removed, seq, e.Version + 1, indexes, st.ts}, nil
+}
+
+// marks the alive record of the shard as deleted, the caller must hold the shard lock (see lockShard)
+func (m *ConcurrentMap) deleteLocked(shard *ConcurrentMapShared, id string, txId string, st stamp) (*shardChange, error) {
+	item, ok := shard.Items["id:"+id]
+	if !ok || item.Deleted {
+		return nil, errors.New("object under specified id was not found")
+	}
+	seq, err := m.wal.Append(&walEntry{Op: walOpDelete, Shard: shard.Id, Keys: []string{"id:" + id}, TxId: txId})
 	if err != nil {
 		return nil, err
 	}
-	// write "next line" symbol to the file
+	if seq > 0 {
+		shard.Seq = seq
+	}
+	shard.flip(item, true, st)
+	m.notify([]string{"id:" + id})
+	return &shardChange{shard: shard, op: walOpDelete, old: item, seq: seq, at: st.ts}, nil
+}
+
+// reports the keys of the changed records, must be called under the shard lock
+func (m *ConcurrentMap) notify(keys []string) {
+	if m.changed != nil {
+		m.changed(keys)
+	}
+}
+
+func destinations(shard *ConcurrentMapShared, keys []string) map[string]*int {
 	destMap := make(map[string]*int)
 	pId := &shard.Id
-
-	offset := ShardOffset{ret, n, false}
-	if indexData != nil {
-		for _, ix := range indexData {
-			fullKey := ix.Field + ":" + ix.Data
-			// Unique index key
-			if ix.Unique {
-				if _, ok := shard.Items[fullKey]; ok {
-					return nil, errors.New("unique primary key duplicate")
-				}
-				shard.Items[fullKey] = &offset
-				destMap[fullKey] = pId
-			} else {
-				// Regular key
-				index := shard.GetCapacityKey(fullKey)
-				lastAvailable := ""
-				for {
-					lastAvailable = strconv.Itoa(index) + ":" + fullKey
-					if _, ok := shard.Items[lastAvailable]; ok {
-						index++
-					} else {
-						break
-					}
-				}
-				shard.Items[lastAvailable] = &offset
-				shard.SetCapacityKey(fullKey, index)
-				destMap[lastAvailable] = pId
-			}
-		}
+	for _, key := range keys {
+		destMap[key] = pId
 	}
-	idKey := "id:" + idStr
-	shard.Items[idKey] = &offset
-	destMap[idKey] = pId
-	return destMap, nil
+	return destMap
 }
 
 // Retrieves an element from map under given key.
@@ -360,8 +491,7 @@ func (m *ConcurrentMap) Get(key string) (*ShardOffset, bool) {
 // Returns the number of elements within the map.
 func (m *ConcurrentMap) Count() int {
 	count := 0
-	for i := 0; i < SHARD_COUNT; i++ {
-		shard := m.Shared[i]
+	for _, shard := range m.Shared {
 		shard.RLock()
 		count += len(shard.Items)
 		shard.RUnlock()
@@ -369,6 +499,21 @@ func (m *ConcurrentMap) Count() int {
 	return count
 }
 
+// Returns the number of records that are not marked as deleted
+func (m *ConcurrentMap) CountAlive() int64 {
+	count := int64(0)
+	for _, shard := range m.Shared {
+		shard.RLock()
+		for key, item := range shard.Items {
+			if !item.Deleted && strings.HasPrefix(key, "id:") {
+				count++
+			}
+		}
+		shard.RUnlock()
+	}
+	return count
+}
+
 // Looks up an item under specified key
 func (m *ConcurrentMap) Has(key string) bool {
 	// Get shard
@@ -418,9 +563,9 @@ func (m *ConcurrentMap) IterBuffered() <-chan Tuple {
 // It returns once the size of each buffered channel is determined,
 // before all the channels are populated using goroutines.
 func snapshot(m *ConcurrentMap) (chans []chan Tuple) {
-	chans = make([]chan Tuple, SHARD_COUNT)
+	chans = make([]chan Tuple, len(m.Shared))
 	wg := sync.WaitGroup{}
-	wg.Add(SHARD_COUNT)
+	wg.Add(len(m.Shared))
 	// Foreach shard.
 	for index, shard := range m.Shared {
 		go func(index int, shard *ConcurrentMapShared) {
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+)
+
+// number of the records Scan, Delete and Restore handle at once, ScanPage returns the rest page by page
+const SCAN_LIMIT = 1000
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+var ErrSortNotIndexed = errors.New("records are sorted only by a range index")
+
+type ScanOptions struct {
+	// range index to sort by (see RangeIndex), the records are ordered by their ids (the order they were written in) if empty
+	SortBy     string
+	Descending bool
+	// number of the records of a page, SCAN_LIMIT if 0
+	Limit int
+	// continuation returned with the previous page, empty for the first page
+	Cursor string
+}
+
+type ScanPage struct {
+	Results [][]byte
+	// cursor of the next page, empty if this is the last one
+	Next string
+}
+
+// position of a record in the order of a scan
+type pageKey struct {
+	Value string `json:"v"`
+	Id    string `json:"i"`
+}
+
+func (k pageKey) less(other pageKey) bool {
+	if k.Value != other.Value {
+		return k.Value < other.Value
+	}
+	return k.Id < other.Id
+}
+
+// reports whether the record comes after the other one in the order of the scan
+func (k pageKey) follows(other pageKey, descending bool) bool {
+	if descending {
+		return k.less(other)
+	}
+	return other.less(k)
+}
+
+func encodeCursor(k pageKey) string {
+	data, _ := json.Marshal(k)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (pageKey, error) {
+	var k pageKey
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || json.Unmarshal(data, &k) != nil || k.Id == "" {
+		return k, ErrInvalidCursor
+	}
+	return k, nil
+}
+
+// a candidate record of a page
+type pageHit struct {
+	key    pageKey
+	shard  *ConcurrentMapShared
+	offset ShardOffset
+}
+
+// Returns a page of the records that match the probe struct (see ScanN), a nil or empty probe matches every record.
+// The order is stable, so the pages can be fetched one by one with the returned cursor. Records are sorted
+// by a range index (see RangeIndex) which is read from the cursor on, the records without a value of the index
+// are left out. ErrSortNotIndexed is returned for any other field
+func (c *Collection) ScanPage(entry CustomStructure, opts ScanOptions) (*ScanPage, error) {
+	return c.scanPageAt(entry, opts, latest)
+}
+
+// same as Collection.ScanPage, but the records are read as of the time the snapshot was taken
+func (s *Snapshot) ScanPage(c *Collection, entry CustomStructure, opts ScanOptions) (*ScanPage, error) {
+	err := s.check(c)
+	if err != nil {
+		return nil, err
+	}
+	return c.scanPageAt(entry, opts, s.ts)
+}
+
+func (c *Collection) scanPageAt(entry CustomStructure, opts ScanOptions, ts uint64) (*ScanPage, error) {
+	c.layout.enter()
+	defer c.layout.leave()
+	var after *pageKey
+	if opts.Cursor != "" {
+		k, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = &k
+	}
+	if opts.SortBy != "" && !c.Map.hasRange(opts.SortBy) {
+		return nil, ErrSortNotIndexed
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = SCAN_LIMIT
+	}
+	var p *QueryPlan
+	var err error
+	if entry != nil {
+		p, err = c.plan(entry)
+		if err != nil {
+			// without conditions every record is listed
+			p = nil
+		}
+	}
+	// the data files are not replaced until the records are read
+	for _, shard := range c.Map.Shared {
+		shard.fileMx.RLock()
+		defer shard.fileMx.RUnlock()
+	}
+	hits := make([]pageHit, 0)
+	for _, shard := range c.Map.Shared {
+		shard.RLock()
+		var offsets []ShardOffset
+		if p != nil {
+			offsets = shard.matchAt(p, math.MaxInt32, ts)
+		}
+		if opts.SortBy != "" {
+			var matching map[int64]bool
+			if p != nil {
+				matching = make(map[int64]bool, len(offsets))
+				for _, offset := range offsets {
+					matching[offset.Start] = true
+				}
+			}
+			// one more record tells whether there is a next page
+			hits = shard.pageAt(opts.SortBy, after, opts.Descending, matching, limit+1, ts, hits)
+			shard.RUnlock()
+			continue
+		}
+		if p == nil {
+			offsets = shard.recordsAt(ts)
+		}
+		shard.RUnlock()
+		for _, offset := range offsets {
+			hit := pageHit{pageKey{"", offset.id}, shard, offset}
+			if after == nil || hit.key.follows(*after, opts.Descending) {
+				hits = append(hits, hit)
+			}
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[j].key.follows(hits[i].key, opts.Descending)
+	})
+
+	page := &ScanPage{make([][]byte, 0, limit), ""}
+	for i := 0; i < len(hits) && len(page.Results) < limit; i++ {
+		data, err := c.Map.ReadAtOffset(hits[i].shard, &hits[i].offset)
+		if err != nil {
+			return nil, err
+		}
+		page.Results = append(page.Results, data)
+	}
+	if len(hits) > limit {
+		page.Next = encodeCursor(hits[limit-1].key)
+	}
+	return page, nil
+}
+
+// Collects the records of the shard that follow the cursor in the order of the range index on the field
+// until there are at least limit of them. The records of a value are collected together, so they can be
+// ordered by their ids. Must be called under the shard lock
+func (shard *ConcurrentMapShared) pageAt(field string, after *pageKey, descending bool, matching map[int64]bool, limit int, ts uint64, hits []pageHit) []pageHit {
+	values, ok := shard.ranges[field]
+	if !ok {
+		return hits
+	}
+	var node *skipNode
+	switch {
+	case after == nil && descending:
+		node = values.last()
+	case after == nil:
+		node = values.seek(RANGE_MARKER)
+	case descending:
+		node = values.seekBack(after.Value)
+	default:
+		node = values.seek(after.Value)
+	}
+	found := 0
+	for node != nil && found < limit {
+		for _, offset := range shard.slotsAt(field+":"+node.value, math.MaxInt32, ts) {
+			hit := pageHit{pageKey{node.value, offset.id}, shard, offset}
+			if after != nil && !hit.key.follows(*after, descending) || matching != nil && !matching[offset.Start] {
+				continue
+			}
+			hits = append(hits, hit)
+			found++
+		}
+		if descending {
+			node = values.prev(node)
+		} else {
+			node = node.next[0]
+		}
+	}
+	return hits
+}
@@ -0,0 +1,238 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// A condition of a query together with the estimated number of the records that satisfy it
+type PlanStep struct {
+	Field  string
+	Data   string
+	Unique bool
+	// number of the records under the key, an upper bound for the regular indexes
+	Estimate int
+}
+
+func (s PlanStep) String() string {
+	kind := "index"
+	if s.Unique {
+		kind = "unique index"
+	}
+	return kind + " " + s.Field + "=" + strconv.Quote(s.Data) + " (~" + strconv.Itoa(s.Estimate) + " records)"
+}
+
+// Every index of the probe struct that is set is a condition of the query: the most selective one
+// drives and its records are checked against the rest (the filters) in memory, so only the matching records
+// are read from the drive. An index that has the value of the zero struct of the type (e.g. strconv.Itoa(p.Age)
+// of an unset Age) is a condition only if no other index is set, so a zero value is looked up only on its own.
+// With CollectionOptions.FirstIndex the probe is looked up by a composite index with all of its fields set
+// or else by the first index that has a value, there are no filters
+type QueryPlan struct {
+	Driver  PlanStep
+	Filters []PlanStep
+}
+
+func (p *QueryPlan) String() string {
+	s := "scan " + p.Driver.String()
+	for _, f := range p.Filters {
+		s += ", filter " + f.String()
+	}
+	return s
+}
+
+// returns the plan ScanN would use for the probe struct
+func (c *Collection) Explain(entry CustomStructure) (*QueryPlan, error) {
+	c.layout.enter()
+	defer c.layout.leave()
+	return c.plan(entry)
+}
+
+func (c *Collection) plan(entry CustomStructure) (*QueryPlan, error) {
+	indexes := entry.GetDataIndex()
+	var zero map[string]string
+	if !c.Options.FirstIndex {
+		zero = zeroIndexes(entry)
+	}
+	conditions := make([]*FullDataIndex, 0, len(indexes))
+	// indexes with the value of the zero struct, they are conditions only if nothing else is set
+	zeroConditions := make([]*FullDataIndex, 0)
+	seen := make(map[string]bool, len(indexes))
+	for _, ix := range indexes {
+		fullKey := ix.Field + ":" + ix.Data
+		// zero values of the range indexes are not set in the probe
+		if ix.Data == "" || isZeroRangeValue(ix.Data) || seen[fullKey] {
+			continue
+		}
+		seen[fullKey] = true
+		if data, ok := zero[ix.Field]; ok && data == ix.Data {
+			zeroConditions = append(zeroConditions, ix)
+			continue
+		}
+		conditions = append(conditions, ix)
+	}
+	if len(conditions) == 0 {
+		conditions = zeroConditions
+	}
+	if len(conditions) == 0 {
+		return nil, errors.New("no matching data")
+	}
+	if c.Options.FirstIndex {
+		driver := conditions[0]
+		for _, ix := range conditions {
+			if isCompositeIndex(ix.Field) {
+				driver = ix
+				break
+			}
+		}
+		return &QueryPlan{PlanStep{driver.Field, driver.Data, driver.Unique, c.Map.estimate(driver)}, nil}, nil
+	}
+
+	steps := make([]PlanStep, 0, len(conditions))
+	for _, ix := range conditions {
+		steps = append(steps, PlanStep{ix.Field, ix.Data, ix.Unique, c.Map.estimate(ix)})
+	}
+	// ties go to the unique and then to the composite indexes, otherwise the declaration order is kept
+	sort.SliceStable(steps, func(i, j int) bool {
+		if steps[i].Estimate != steps[j].Estimate {
+			return steps[i].Estimate < steps[j].Estimate
+		}
+		if steps[i].Unique != steps[j].Unique {
+			return steps[i].Unique
+		}
+		return isCompositeIndex(steps[i].Field) && !isCompositeIndex(steps[j].Field)
+	})
+	return &QueryPlan{steps[0], steps[1:]}, nil
+}
+
+// returns the data of the indexes of the zero struct of the type of the probe by their fields
+func zeroIndexes(entry CustomStructure) map[string]string {
+	t := reflect.TypeOf(entry)
+	var zero interface{}
+	if t.Kind() == reflect.Ptr {
+		zero = reflect.New(t.Elem()).Interface()
+	} else {
+		zero = reflect.Zero(t).Interface()
+	}
+	data := make(map[string]string)
+	if s, ok := zero.(CustomStructure); ok {
+		for _, ix := range s.GetDataIndex() {
+			data[ix.Field] = ix.Data
+		}
+	}
+	return data
+}
+
+// returns the number of the records stored under the index key. The capacity of a regular index
+// is its highest slot, so the deleted records and the holes are counted as well
+func (m *ConcurrentMap) estimate(ix *FullDataIndex) int {
+	fullKey := ix.Field + ":" + ix.Data
+	if ix.Unique {
+		if _, ok := m.uniqueOwner(fullKey); ok {
+			return 1
+		}
+		return 0
+	}
+	n := 0
+	for _, shard := range m.Shared {
+		shard.RLock()
+		if capacity, ok := shard.Capacities["n:"+fullKey]; ok {
+			n += capacity + 1
+		}
+		shard.RUnlock()
+	}
+	return n
+}
+
+// returns up to limit alive records of the shard which satisfy the plan at the read timestamp,
+// must be called under the shard lock
+func (shard *ConcurrentMapShared) matchAt(p *QueryPlan, limit int, ts uint64) []ShardOffset {
+	var candidates []ShardOffset
+	driverKey := p.Driver.Field + ":" + p.Driver.Data
+	if p.Driver.Unique {
+		if offset, ok := shard.uniqueAt(driverKey, ts); ok {
+			candidates = []ShardOffset{offset}
+		}
+	} else {
+		candidates = shard.slotsAt(driverKey, math.MaxInt32, ts)
+	}
+	for _, f := range p.Filters {
+		if len(candidates) == 0 {
+			break
+		}
+		// records are told apart by their location in the data file
+		matching := make(map[int64]bool)
+		fullKey := f.Field + ":" + f.Data
+		if f.Unique {
+			if offset, ok := shard.uniqueAt(fullKey, ts); ok {
+				matching[offset.Start] = true
+			}
+		} else {
+			for _, offset := range shard.slotsAt(fullKey, math.MaxInt32, ts) {
+				matching[offset.Start] = true
+			}
+		}
+		filtered := candidates[:0]
+		for _, offset := range candidates {
+			if matching[offset.Start] {
+				filtered = append(filtered, offset)
+			}
+		}
+		candidates = filtered
+	}
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates
+}
+
+// reads up to limit records of the shard which satisfy the plan (see findInShardAt)
+func (m *ConcurrentMap) matchInShardAt(shard *ConcurrentMapShared, p *QueryPlan, limit int, ts uint64, results [][]byte) ([][]byte, error) {
+	shard.fileMx.RLock()
+	defer shard.fileMx.RUnlock()
+	shard.RLock()
+	offsets := shard.matchAt(p, limit-len(results), ts)
+	shard.RUnlock()
+	for i := range offsets {
+		data, err := m.ReadAtOffset(shard, &offsets[i])
+		if err != nil {
+			return results, err
+		}
+		results = append(results, data)
+	}
+	return results, nil
+}
+
+// runs the plan at the read timestamp
+func (c *Collection) execute(p *QueryPlan, limit int, ts uint64) ([][]byte, error) {
+	shards := c.Map.Shared
+	if p.Driver.Unique && ts == latest {
+		// the current owner of a unique key is known
+		shard, err := c.getShardByKeySafe(p.Driver.Field + ":" + p.Driver.Data)
+		if err != nil {
+			return nil, err
+		}
+		shards = []*ConcurrentMapShared{shard}
+	}
+	results := make([][]byte, 0)
+	var err error
+	for _, shard := range shards {
+		results, err = c.Map.matchInShardAt(shard, p, limit, ts, results)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) >= limit {
+			break
+		}
+	}
+	if len(results) == 0 {
+		if p.Driver.Unique {
+			return nil, errNotFound
+		}
+		return nil, errors.New("zero results")
+	}
+	return results, nil
+}
@@ -0,0 +1,639 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// comparison operators of the conditions
+const (
+	OP_EQ = iota
+	OP_NE
+	OP_GT
+	OP_GTE
+	OP_LT
+	OP_LTE
+)
+
+// A condition of a query (see Query). A field of a record is compared by its index value if the record has
+// an index with that name, otherwise by the field of the struct
+type Condition interface {
+	// reports whether the record satisfies the condition
+	match(r *queryRecord) bool
+	// returns the records of the shard that might satisfy the condition, false if the condition
+	// can not be answered by the indexes (keys). Must be called under the shard lock
+	candidates(shard *ConcurrentMapShared, ts uint64, keys indexKeys) ([]ShardOffset, bool)
+	// returns the comparisons the condition consists of
+	comparisons() []*comparison
+}
+
+// comparison -> full key of the index value it is answered by
+type indexKeys map[*comparison]string
+
+type comparison struct {
+	field string
+	op    int
+	value interface{}
+}
+
+type andCondition struct {
+	conditions []Condition
+}
+
+type orCondition struct {
+	conditions []Condition
+}
+
+type notCondition struct {
+	condition Condition
+}
+
+func And(conditions ...Condition) Condition {
+	return &andCondition{conditions}
+}
+
+func Or(conditions ...Condition) Condition {
+	return &orCondition{conditions}
+}
+
+func Not(condition Condition) Condition {
+	return &notCondition{condition}
+}
+
+// Builds the conditions on a field
+type FieldCondition struct {
+	field string
+	// receives the condition when the field is a part of a query (see Query.Where)
+	query *Query
+}
+
+func Field(name string) *FieldCondition {
+	return &FieldCondition{name, nil}
+}
+
+func (f *FieldCondition) Eq(value interface{}) Condition {
+	return &comparison{f.field, OP_EQ, value}
+}
+
+func (f *FieldCondition) Ne(value interface{}) Condition {
+	return &comparison{f.field, OP_NE, value}
+}
+
+func (f *FieldCondition) Gt(value interface{}) Condition {
+	return &comparison{f.field, OP_GT, value}
+}
+
+func (f *FieldCondition) Gte(value interface{}) Condition {
+	return &comparison{f.field, OP_GTE, value}
+}
+
+func (f *FieldCondition) Lt(value interface{}) Condition {
+	return &comparison{f.field, OP_LT, value}
+}
+
+func (f *FieldCondition) Lte(value interface{}) Condition {
+	return &comparison{f.field, OP_LTE, value}
+}
+
+// from and to are inclusive
+func (f *FieldCondition) Between(from, to interface{}) Condition {
+	return And(f.Gte(from), f.Lte(to))
+}
+
+func (f *FieldCondition) In(values ...interface{}) Condition {
+	conditions := make([]Condition, 0, len(values))
+	for _, value := range values {
+		conditions = append(conditions, f.Eq(value))
+	}
+	return Or(conditions...)
+}
+
+// A query over the records of a collection. Conditions are answered by the unique, regular and range indexes
+// where possible, otherwise every record of the collection is read and checked.
+// Matching records are returned in the order of the shards and of the data files
+//	elements, err := c.Query().Where("Age").Gt(18).Or(db.Field("Country").Eq("X")).Limit(50).Offset(100).Find()
+type Query struct {
+	collection *Collection
+	snapshot   *Snapshot
+	condition  Condition
+	limit      int
+	offset     int
+}
+
+func (c *Collection) Query() *Query {
+	return &Query{c, nil, nil, 0, 0}
+}
+
+// same as Collection.Query, but the records are read as of the time the snapshot was taken
+func (s *Snapshot) Query(c *Collection) *Query {
+	return &Query{c, s, nil, 0, 0}
+}
+
+// starts a condition on the field that is combined with the previous ones by AND
+func (q *Query) Where(field string) *QueryField {
+	return &QueryField{q, field}
+}
+
+// Builds a condition on a field of the query
+type QueryField struct {
+	query *Query
+	field string
+}
+
+func (qf *QueryField) Eq(value interface{}) *Query {
+	return qf.query.And(Field(qf.field).Eq(value))
+}
+
+func (qf *QueryField) Ne(value interface{}) *Query {
+	return qf.query.And(Field(qf.field).Ne(value))
+}
+
+func (qf *QueryField) Gt(value interface{}) *Query {
+	return qf.query.And(Field(qf.field).Gt(value))
+}
+
+func (qf *QueryField) Gte(value interface{}) *Query {
+	return qf.query.And(Field(qf.field).Gte(value))
+}
+
+func (qf *QueryField) Lt(value interface{}) *Query {
+	return qf.query.And(Field(qf.field).Lt(value))
+}
+
+func (qf *QueryField) Lte(value interface{}) *Query {
+	return qf.query.And(Field(qf.field).Lte(value))
+}
+
+func (qf *QueryField) Between(from, to interface{}) *Query {
+	return qf.query.And(Field(qf.field).Between(from, to))
+}
+
+func (qf *QueryField) In(values ...interface{}) *Query {
+	return qf.query.And(Field(qf.field).In(values...))
+}
+
+func (q *Query) And(condition Condition) *Query {
+	if q.condition == nil {
+		q.condition = condition
+	} else {
+		q.condition = And(q.condition, condition)
+	}
+	return q
+}
+
+// the query matches the records that satisfy either the previous conditions or the given one
+func (q *Query) Or(condition Condition) *Query {
+	if q.condition == nil {
+		q.condition = condition
+	} else {
+		q.condition = Or(q.condition, condition)
+	}
+	return q
+}
+
+// negates the previous conditions
+func (q *Query) Not() *Query {
+	if q.condition != nil {
+		q.condition = Not(q.condition)
+	}
+	return q
+}
+
+// maximal number of the returned records, 0 means no limit
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// number of the matching records to skip
+func (q *Query) Offset(n int) *Query {
+	q.offset = n
+	return q
+}
+
+// returns the decoded matching records
+func (q *Query) Find() ([]*Element, error) {
+	elements := make([]*Element, 0)
+	err := q.each(func(e *Element) bool {
+		elements = append(elements, e)
+		return true
+	})
+	return elements, err
+}
+
+// passes the matching records to fn until it returns false, Offset and Limit are applied
+func (q *Query) each(fn func(e *Element) bool) error {
+	c := q.collection
+	if c == nil {
+		return errors.New("query has no collection")
+	}
+	c.layout.enter()
+	defer c.layout.leave()
+	ts := latest
+	if q.snapshot != nil {
+		err := q.snapshot.check(c)
+		if err != nil {
+			return err
+		}
+		ts = q.snapshot.ts
+	}
+	limit := q.limit
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	var keys indexKeys
+	if q.condition != nil {
+		keys = c.Map.indexKeys(q.condition.comparisons())
+	}
+	skipped, found := 0, 0
+	for _, shard := range c.Map.Shared {
+		done := false
+		err := c.eachInShardAt(shard, q.condition, ts, keys, func(e *Element) bool {
+			if skipped < q.offset {
+				skipped++
+				return true
+			}
+			found++
+			done = !fn(e) || found >= limit
+			return !done
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+	return nil
+}
+
+// Returns the keys of the comparisons that can be answered by the indexes. The check is collection wide,
+// so the records of a shard that has no key for the value are known not to match. A zero value is not looked up,
+// the records that leave the index unset for it are compared by the field of the struct (see queryRecord.compare)
+func (m *ConcurrentMap) indexKeys(comparisons []*comparison) indexKeys {
+	keys := make(indexKeys)
+	for _, cmp := range comparisons {
+		if cmp.op == OP_NE || cmp.op == OP_EQ && isZeroValue(cmp.value) {
+			continue
+		}
+		if kind := m.rangeKind(cmp.field); kind != 0 {
+			// an ordered comparison needs a range index
+			data, err := rangeOperand(kind, cmp.op, cmp.value)
+			if err == nil {
+				keys[cmp] = cmp.field + ":" + data
+			}
+			continue
+		}
+		if cmp.op == OP_EQ && m.hasIndex(cmp.field) {
+			keys[cmp] = cmp.field + ":" + fmt.Sprint(cmp.value)
+		}
+	}
+	return keys
+}
+
+func isZeroValue(value interface{}) bool {
+	return value == nil || reflect.ValueOf(value).IsZero()
+}
+
+// reports whether any shard has a range index on the field
+func (m *ConcurrentMap) hasRange(field string) bool {
+	return m.rangeKind(field) != 0
+}
+
+// returns the kind of the values of the range index on the field (see RangeValue), 0 if there is none
+func (m *ConcurrentMap) rangeKind(field string) byte {
+	for _, shard := range m.Shared {
+		var first *skipNode
+		shard.RLock()
+		if values, ok := shard.ranges[field]; ok {
+			first = values.seek(RANGE_MARKER)
+		}
+		shard.RUnlock()
+		if first != nil {
+			return first.value[len(RANGE_MARKER)]
+		}
+	}
+	return 0
+}
+
+// reports whether the records of any shard are stored under an index with the name
+func (m *ConcurrentMap) hasIndex(field string) bool {
+	for _, shard := range m.Shared {
+		shard.RLock()
+		ok := shard.fields[field]
+		shard.RUnlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reads the records of the shard that satisfy the condition at the read timestamp and passes them to fn
+// until it returns false. The shard lock is held only while the candidates are collected
+func (c *Collection) eachInShardAt(shard *ConcurrentMapShared, condition Condition, ts uint64, keys indexKeys, fn func(e *Element) bool) error {
+	shard.fileMx.RLock()
+	defer shard.fileMx.RUnlock()
+	shard.RLock()
+	var offsets []ShardOffset
+	ok := false
+	if condition != nil {
+		offsets, ok = condition.candidates(shard, ts, keys)
+	}
+	if !ok {
+		offsets = shard.recordsAt(ts)
+	}
+	shard.RUnlock()
+	// records are returned in the order they were written into the data file
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].Start < offsets[j].Start })
+	for i := range offsets {
+		data, err := c.Map.ReadAtOffset(shard, &offsets[i])
+		if err != nil {
+			return err
+		}
+		e, err := c.DecodeElement(data)
+		if err != nil {
+			return err
+		}
+		if condition != nil && !condition.match(newQueryRecord(e)) {
+			continue
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// returns the alive records of the shard at the read timestamp, must be called under the shard lock
+func (shard *ConcurrentMapShared) recordsAt(ts uint64) []ShardOffset {
+	offsets := make([]ShardOffset, 0)
+	for key := range shard.Items {
+		if !strings.HasPrefix(key, "id:") {
+			continue
+		}
+		if item, ok := shard.itemAt(key, ts); ok && !shard.deletedAt(item, ts) {
+			offsets = append(offsets, *item)
+		}
+	}
+	return offsets
+}
+
+func (cmp *comparison) candidates(shard *ConcurrentMapShared, ts uint64, keys indexKeys) ([]ShardOffset, bool) {
+	key, ok := keys[cmp]
+	if !ok {
+		return nil, false
+	}
+	if cmp.op == OP_EQ {
+		if offset, ok := shard.uniqueAt(key, ts); ok {
+			return []ShardOffset{offset}, true
+		}
+		return shard.slotsAt(key, math.MaxInt32, ts), true
+	}
+	// the bounds only narrow the range down, every candidate is checked anyway
+	data := key[len(cmp.field)+1:]
+	from, to, bounded := data[:len(RANGE_MARKER)+1], data, true
+	if cmp.op == OP_GT || cmp.op == OP_GTE {
+		from, to, bounded = data, "", false
+	}
+	hits := shard.rangeAt(cmp.field, from, to, bounded, math.MaxInt32, ts, nil)
+	offsets := make([]ShardOffset, 0, len(hits))
+	for _, hit := range hits {
+		offsets = append(offsets, hit.offset)
+	}
+	return offsets, true
+}
+
+func (cmp *comparison) comparisons() []*comparison {
+	return []*comparison{cmp}
+}
+
+func (cmp *comparison) match(r *queryRecord) bool {
+	c, ok := r.compare(cmp.field, cmp.value)
+	switch cmp.op {
+	case OP_EQ:
+		return ok && c == 0
+	case OP_NE:
+		return !ok || c != 0
+	case OP_GT:
+		return ok && c > 0
+	case OP_GTE:
+		return ok && c >= 0
+	case OP_LT:
+		return ok && c < 0
+	case OP_LTE:
+		return ok && c <= 0
+	}
+	return false
+}
+
+func (and *andCondition) comparisons() []*comparison {
+	return collectComparisons(and.conditions)
+}
+
+func (and *andCondition) match(r *queryRecord) bool {
+	for _, condition := range and.conditions {
+		if !condition.match(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// the smallest set of the candidates of the conditions answered by the indexes
+func (and *andCondition) candidates(shard *ConcurrentMapShared, ts uint64, keys indexKeys) ([]ShardOffset, bool) {
+	var best []ShardOffset
+	found := false
+	for _, condition := range and.conditions {
+		offsets, ok := condition.candidates(shard, ts, keys)
+		if ok && (!found || len(offsets) < len(best)) {
+			best, found = offsets, true
+		}
+	}
+	return best, found
+}
+
+func (or *orCondition) comparisons() []*comparison {
+	return collectComparisons(or.conditions)
+}
+
+func (or *orCondition) match(r *queryRecord) bool {
+	for _, condition := range or.conditions {
+		if condition.match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// the union of the candidates, every condition has to be answered by the indexes
+func (or *orCondition) candidates(shard *ConcurrentMapShared, ts uint64, keys indexKeys) ([]ShardOffset, bool) {
+	offsets := make([]ShardOffset, 0)
+	seen := make(map[int64]bool)
+	for _, condition := range or.conditions {
+		found, ok := condition.candidates(shard, ts, keys)
+		if !ok {
+			return nil, false
+		}
+		for _, offset := range found {
+			if !seen[offset.Start] {
+				seen[offset.Start] = true
+				offsets = append(offsets, offset)
+			}
+		}
+	}
+	return offsets, true
+}
+
+func (not *notCondition) comparisons() []*comparison {
+	return not.condition.comparisons()
+}
+
+func (not *notCondition) match(r *queryRecord) bool {
+	return !not.condition.match(r)
+}
+
+func (not *notCondition) candidates(shard *ConcurrentMapShared, ts uint64, keys indexKeys) ([]ShardOffset, bool) {
+	return nil, false
+}
+
+func collectComparisons(conditions []Condition) []*comparison {
+	comparisons := make([]*comparison, 0)
+	for _, condition := range conditions {
+		comparisons = append(comparisons, condition.comparisons()...)
+	}
+	return comparisons
+}
+
+// a decoded record checked against the conditions
+type queryRecord struct {
+	payload reflect.Value
+	// field -> index value
+	indexes map[string]string
+}
+
+func newQueryRecord(e *Element) *queryRecord {
+	r := &queryRecord{reflect.Indirect(reflect.ValueOf(e.Payload)), make(map[string]string)}
+	if structure, ok := e.Payload.(CustomStructure); ok {
+		for _, ix := range structure.GetDataIndex() {
+			r.indexes[ix.Field] = ix.Data
+		}
+	}
+	return r
+}
+
+// compares the field of the record with the value, false if they are not comparable.
+// An index without a value leaves the comparison to the field of the struct
+func (r *queryRecord) compare(field string, value interface{}) (int, bool) {
+	data, indexed := r.indexes[field]
+	if indexed && data != "" {
+		return compareIndexData(data, value)
+	}
+	if r.payload.Kind() == reflect.Struct {
+		f := r.payload.FieldByName(field)
+		if f.IsValid() && f.CanInterface() {
+			return compareValues(f.Interface(), value)
+		}
+	}
+	if indexed {
+		return compareIndexData(data, value)
+	}
+	return 0, false
+}
+
+// compares the value of an index with the value of a condition: the range indexes by their encoding
+// (integers and floats as numbers), the rest as numbers if both are numbers, otherwise as strings
+func compareIndexData(data string, value interface{}) (int, bool) {
+	if strings.HasPrefix(data, RANGE_MARKER) {
+		encoded, err := RangeValue(value)
+		if err != nil || len(encoded) < 2 || len(data) < 2 {
+			return 0, false
+		}
+		if encoded[:2] != data[:2] {
+			// values of different types are not comparable, unless both are numbers
+			x, ok := decodeRangeNumber(data)
+			y, isNumber := toFloat(value)
+			if !ok || !isNumber {
+				return 0, false
+			}
+			return compareFloats(x, y), true
+		}
+		return strings.Compare(data, encoded), true
+	}
+	s := fmt.Sprint(value)
+	if number, ok := toFloat(value); ok {
+		if parsed, err := strconv.ParseFloat(data, 64); err == nil {
+			return compareFloats(parsed, number), true
+		}
+	}
+	return strings.Compare(data, s), true
+}
+
+func compareValues(a, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		return compareFloats(x, y), true
+	}
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case time.Time:
+		y, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		if x.Before(y) {
+			return -1, true
+		} else if x.After(y) {
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		y, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if x == y {
+			return 0, true
+		} else if !x {
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+func compareFloats(x, y float64) int {
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
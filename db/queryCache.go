@@ -0,0 +1,245 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"github.com/allegro/bigcache"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Results of FindById and ScanN kept in memory. Every result is registered under the keys it depends on:
+// the index keys ("<field>:<value>") of its conditions and the "id" keys of its records. A change of a record
+// drops the results registered under any of the keys of the record, so a cached result is never stale
+type queryCache struct {
+	// nil if the cache is disabled
+	store *bigcache.BigCache
+	opts  CacheOptions
+
+	// key -> cache keys of the results that depend on it
+	deps map[string]map[string]bool
+	// cache key -> keys it is registered under
+	registered map[string][]string
+	// cache keys removed by the storage since the last put, they are unregistered by the next put
+	evicted   []string
+	evictedMx sync.Mutex
+	// grows with every change, a result computed while the records were changing is not stored
+	gen uint64
+	mx  sync.Mutex
+
+	hits          int64
+	misses        int64
+	evictions     int64
+	invalidations int64
+}
+
+func newQueryCache(opts CacheOptions) *queryCache {
+	qc := &queryCache{nil, opts, make(map[string]map[string]bool), make(map[string][]string), nil, sync.Mutex{}, 0, sync.Mutex{}, 0, 0, 0, 0}
+	if !opts.Disabled {
+		qc.store = newCacheStore(opts, qc.removed)
+	}
+	return qc
+}
+
+// counts the results removed by the storage itself and queues them to be unregistered,
+// called under the lock of the storage, so qc.mx can not be taken here
+func (qc *queryCache) removed(key string, entry []byte, reason bigcache.RemoveReason) {
+	if reason != bigcache.Deleted {
+		atomic.AddInt64(&qc.evictions, 1)
+		qc.evictedMx.Lock()
+		// the key shares the memory of the storage, it is copied to be kept
+		qc.evicted = append(qc.evicted, string(append([]byte(nil), key...)))
+		qc.evictedMx.Unlock()
+	}
+}
+
+// unregisters the evicted results, a key that has been stored again since is kept. qc.mx must be held
+func (qc *queryCache) prune() {
+	qc.evictedMx.Lock()
+	evicted := qc.evicted
+	qc.evicted = nil
+	qc.evictedMx.Unlock()
+	for _, key := range evicted {
+		if _, err := qc.store.Get(key); err != nil {
+			qc.unregister(key)
+		}
+	}
+}
+
+func (qc *queryCache) stats() CacheStats {
+	s := CacheStats{atomic.LoadInt64(&qc.hits), atomic.LoadInt64(&qc.misses),
+		atomic.LoadInt64(&qc.evictions), atomic.LoadInt64(&qc.invalidations), 0, 0}
+	if qc.store != nil {
+		s.Entries = qc.store.Len()
+		s.Bytes = int64(qc.store.Capacity())
+	}
+	return s
+}
+
+// returns the generation of the cache, it has to be taken before the result is computed (see put)
+func (qc *queryCache) begin() uint64 {
+	qc.mx.Lock()
+	defer qc.mx.Unlock()
+	return qc.gen
+}
+
+// stores the result under the cache key unless the records have changed since begin
+func (qc *queryCache) put(gen uint64, key string, deps []string, value interface{}) error {
+	if qc.store == nil {
+		return nil
+	}
+	var data bytes.Buffer
+	err := gob.NewEncoder(&data).Encode(value)
+	if err != nil {
+		return err
+	}
+	entry := data.Bytes()
+	if !qc.opts.Uncompressed {
+		var compressedBuf bytes.Buffer
+		writer := bufio.NewWriter(&compressedBuf)
+		gzipw, _ := gzip.NewWriterLevel(writer, gzip.BestSpeed)
+		_, err = gzipw.Write(entry)
+		if err != nil {
+			return err
+		}
+		gzipw.Close()
+		writer.Flush()
+		entry = compressedBuf.Bytes()
+	}
+
+	qc.mx.Lock()
+	defer qc.mx.Unlock()
+	qc.prune()
+	if gen != qc.gen {
+		return nil
+	}
+	qc.unregister(key)
+	for _, dep := range deps {
+		keys, ok := qc.deps[dep]
+		if !ok {
+			keys = make(map[string]bool)
+			qc.deps[dep] = keys
+		}
+		keys[key] = true
+	}
+	qc.registered[key] = deps
+	return qc.store.Set(key, entry)
+}
+
+// decodes the result stored under the cache key into value (a pointer), false if there is none
+func (qc *queryCache) get(key string, value interface{}) bool {
+	if qc.store == nil {
+		return false
+	}
+	if qc.load(key, value) {
+		atomic.AddInt64(&qc.hits, 1)
+		return true
+	}
+	atomic.AddInt64(&qc.misses, 1)
+	return false
+}
+
+func (qc *queryCache) load(key string, value interface{}) bool {
+	data, err := qc.store.Get(key)
+	if err != nil || len(data) == 0 {
+		return false
+	}
+	if !qc.opts.Uncompressed {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return false
+		}
+		defer reader.Close()
+		data, err = ioutil.ReadAll(reader)
+		if err != nil {
+			return false
+		}
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value) == nil
+}
+
+// drops the results that depend on any of the keys of the changed records, slot keys of the regular indexes
+// are reduced to the index keys. Called by the map under the shard lock
+func (qc *queryCache) invalidate(keys []string) {
+	qc.mx.Lock()
+	defer qc.mx.Unlock()
+	qc.gen++
+	for _, key := range keys {
+		if _, fullKey, ok := splitSlotKey(key); ok {
+			key = fullKey
+		}
+		for cacheKey := range qc.deps[key] {
+			qc.unregister(cacheKey)
+			qc.store.Delete(cacheKey)
+			atomic.AddInt64(&qc.invalidations, 1)
+		}
+	}
+}
+
+// drops every result
+func (qc *queryCache) reset() {
+	qc.mx.Lock()
+	defer qc.mx.Unlock()
+	qc.gen++
+	qc.deps = make(map[string]map[string]bool)
+	qc.registered = make(map[string][]string)
+	if qc.store != nil {
+		qc.store.Reset()
+	}
+	qc.evictedMx.Lock()
+	qc.evicted = nil
+	qc.evictedMx.Unlock()
+}
+
+// removes the cache key from the keys it depends on, qc.mx must be held
+func (qc *queryCache) unregister(cacheKey string) {
+	for _, dep := range qc.registered[cacheKey] {
+		delete(qc.deps[dep], cacheKey)
+		if len(qc.deps[dep]) == 0 {
+			delete(qc.deps, dep)
+		}
+	}
+	delete(qc.registered, cacheKey)
+}
+
+// creates the cache of the results and subscribes it to the changes of the records
+func (c *Collection) useCache(opts CacheOptions) {
+	c.results = newQueryCache(opts)
+	c.Cache = c.results.store
+	c.Map.changed = c.results.invalidate
+}
+
+func (c *Collection) scanCacheKey(indexes []*FullDataIndex, limit int) string {
+	return "scan:" + strconv.Itoa(limit) + ":" + c.StringifyDataIndex(indexes)
+}
+
+// keys a cached scan depends on: its conditions and its records
+func (c *Collection) scanDeps(p *QueryPlan, dataSet [][]byte) ([]string, error) {
+	deps := make([]string, 0, 1+len(p.Filters)+len(dataSet))
+	for _, step := range append([]PlanStep{p.Driver}, p.Filters...) {
+		deps = append(deps, step.Field+":"+step.Data)
+	}
+	for _, data := range dataSet {
+		e, err := c.DecodeElement(data)
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, "id:"+e.Id)
+	}
+	return deps, nil
+}
+
+// returns every key of the records, must be called under the shard lock
+func (shard *ConcurrentMapShared) keysOfItems(items map[*ShardOffset]bool) []string {
+	keys := make([]string, 0)
+	for key, item := range shard.Items {
+		if items[item] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,346 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of the range indexes are prefixed with this byte and the type of the value,
+// the rest of the value is encoded so that the string order matches the order of the values
+const RANGE_MARKER = "\x00"
+
+// Returns a regular index which keeps its values ordered in every shard, so the records can be found
+// by a range of values (see Collection.ScanRange) as well as by an exact one. Supported are signed and unsigned
+// integers, floats, time.Time and strings. Like regexp.MustCompile, panics on other types: the type of the field
+// is fixed in the code of GetDataIndex, so the mistake shows up with the first record. RangeValue returns the error instead
+func RangeIndex(field string, value interface{}) *FullDataIndex {
+	data, err := RangeValue(value)
+	if err != nil {
+		panic("range index " + field + ": " + err.Error())
+	}
+	return &FullDataIndex{field, data, false}
+}
+
+// encodes the value of a range index (see RangeIndex)
+func RangeValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case int:
+		return encodeRangeInt(int64(v)), nil
+	case int8:
+		return encodeRangeInt(int64(v)), nil
+	case int16:
+		return encodeRangeInt(int64(v)), nil
+	case int32:
+		return encodeRangeInt(int64(v)), nil
+	case int64:
+		return encodeRangeInt(v), nil
+	case uint:
+		return encodeRangeUnsigned(uint64(v)), nil
+	case uint8:
+		return encodeRangeUnsigned(uint64(v)), nil
+	case uint16:
+		return encodeRangeUnsigned(uint64(v)), nil
+	case uint32:
+		return encodeRangeUnsigned(uint64(v)), nil
+	case uint64:
+		return encodeRangeUnsigned(v), nil
+	case float32:
+		return encodeRangeFloat(float64(v)), nil
+	case float64:
+		return encodeRangeFloat(v), nil
+	case time.Time:
+		return encodeRangeTime(v), nil
+	case string:
+		return RANGE_MARKER + "s" + v, nil
+	}
+	return "", errors.New("unsupported type " + fmt.Sprintf("%T", value))
+}
+
+func encodeRangeInt(v int64) string {
+	// the sign bit is flipped, so the negative numbers go first
+	return RANGE_MARKER + "i" + encodeRangeUint(uint64(v)^(1<<63))
+}
+
+// the unsigned integers are kept apart from the signed ones, so the values above math.MaxInt64 keep their order
+func encodeRangeUnsigned(v uint64) string {
+	return RANGE_MARKER + "u" + encodeRangeUint(v)
+}
+
+func encodeRangeTime(v time.Time) string {
+	return RANGE_MARKER + "t" + encodeRangeUint(uint64(v.UnixNano())^(1<<63))
+}
+
+func encodeRangeFloat(v float64) string {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		// the order of the negative numbers is reversed
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return RANGE_MARKER + "f" + encodeRangeUint(bits)
+}
+
+func encodeRangeUint(v uint64) string {
+	s := strconv.FormatUint(v, 16)
+	return strings.Repeat("0", 16-len(s)) + s
+}
+
+// returns the value of a range index of integers or floats as a float, false for the other types
+func decodeRangeNumber(data string) (float64, bool) {
+	if len(data) <= len(RANGE_MARKER) {
+		return 0, false
+	}
+	bits, err := strconv.ParseUint(data[len(RANGE_MARKER)+1:], 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch data[len(RANGE_MARKER)] {
+	case 'i':
+		return float64(int64(bits ^ (1 << 63))), true
+	case 'u':
+		return float64(bits), true
+	case 'f':
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), true
+	}
+	return 0, false
+}
+
+// Encodes the operand of a comparison with the range index whose values are of the kind (see RangeValue),
+// the numbers are converted to the kind of the index. A number out of the integers of the index (a fraction
+// or a negative number for the unsigned ones) is rounded to the nearest integer within the bound,
+// e.g. "> 2.5" starts at 3. Nothing is equal to such a number
+func rangeOperand(kind byte, op int, value interface{}) (string, error) {
+	number, ok := toFloat(value)
+	if !ok {
+		return RangeValue(value)
+	}
+	if kind == 'f' {
+		return encodeRangeFloat(number), nil
+	}
+	if kind != 'i' && kind != 'u' {
+		return RangeValue(value)
+	}
+	lower := op == OP_GT || op == OP_GTE
+	switch v := reflect.ValueOf(value); v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if kind == 'i' {
+			return encodeRangeInt(v.Int()), nil
+		}
+		if v.Int() >= 0 {
+			return encodeRangeUnsigned(uint64(v.Int())), nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if kind == 'u' {
+			return encodeRangeUnsigned(v.Uint()), nil
+		}
+		if v.Uint() <= math.MaxInt64 {
+			return encodeRangeInt(int64(v.Uint())), nil
+		}
+	default:
+		if number == math.Trunc(number) && number >= 0 && number < math.MaxUint64 && kind == 'u' {
+			return encodeRangeUnsigned(uint64(number)), nil
+		}
+		if number == math.Trunc(number) && number >= math.MinInt64 && number < math.MaxInt64 && kind == 'i' {
+			return encodeRangeInt(int64(number)), nil
+		}
+	}
+	// the number is out of the integers of the index
+	if op == OP_EQ {
+		return RANGE_MARKER + string(kind), nil
+	}
+	if lower {
+		number = math.Ceil(number)
+	} else {
+		number = math.Floor(number)
+	}
+	if kind == 'u' {
+		if number < 0 {
+			if lower {
+				return encodeRangeUnsigned(0), nil
+			}
+			// below every value
+			return RANGE_MARKER + "u", nil
+		}
+		if number >= math.MaxUint64 {
+			return encodeRangeUnsigned(math.MaxUint64), nil
+		}
+		return encodeRangeUnsigned(uint64(number)), nil
+	}
+	if number >= math.MaxInt64 {
+		return encodeRangeInt(math.MaxInt64), nil
+	} else if number <= math.MinInt64 {
+		return encodeRangeInt(math.MinInt64), nil
+	}
+	return encodeRangeInt(int64(number)), nil
+}
+
+// encoded zero values of the range indexes
+var zeroRangeValues = map[string]bool{
+	encodeRangeInt(0):            true,
+	encodeRangeUnsigned(0):       true,
+	encodeRangeFloat(0):          true,
+	encodeRangeTime(time.Time{}): true,
+	RANGE_MARKER + "s":           true,
+}
+
+// reports whether the data is a zero value of a range index, like the unset fields of a probe struct
+func isZeroRangeValue(data string) bool {
+	return zeroRangeValues[data]
+}
+
+// splits the full key of a range index ("<field>:<value>") into the field and the value
+func splitRangeKey(fullKey string) (string, string, bool) {
+	pos := strings.Index(fullKey, ":"+RANGE_MARKER)
+	if pos < 0 {
+		return "", "", false
+	}
+	return fullKey[:pos], fullKey[pos+1:], true
+}
+
+// remembers the value of a range index, must be called under the shard lock.
+// Values are not removed together with the last record, compaction drops them (see rebuildRanges)
+func (shard *ConcurrentMapShared) addRange(fullKey string) {
+	field, value, ok := splitRangeKey(fullKey)
+	if !ok {
+		return
+	}
+	if shard.ranges == nil {
+		shard.ranges = make(map[string]*skipList)
+	}
+	values, ok := shard.ranges[field]
+	if !ok {
+		values = newSkipList()
+		shard.ranges[field] = values
+	}
+	values.insert(value)
+}
+
+// recalculates the values of the range indexes and the names of the indexes from the keys of the shard,
+// must be called under the shard lock
+func (shard *ConcurrentMapShared) rebuildRanges() {
+	shard.ranges = nil
+	shard.fields = nil
+	for key := range shard.Items {
+		if _, fullKey, ok := splitSlotKey(key); ok {
+			shard.addRange(fullKey)
+			shard.addField(fullKey)
+		} else if !strings.HasPrefix(key, "id:") {
+			shard.addField(key)
+		}
+	}
+}
+
+// a record of a range index found in a shard
+type rangeHit struct {
+	value  string
+	shard  *ConcurrentMapShared
+	offset ShardOffset
+}
+
+// collects up to limit alive records of the range index with values from..to (to is ignored if bounded is false)
+// at the read timestamp, must be called under the shard lock
+func (shard *ConcurrentMapShared) rangeAt(field, from, to string, bounded bool, limit int, ts uint64, hits []rangeHit) []rangeHit {
+	values, ok := shard.ranges[field]
+	if !ok {
+		return hits
+	}
+	found := 0
+	for node := values.seek(from); node != nil && found < limit; node = node.next[0] {
+		if bounded && node.value > to {
+			break
+		}
+		for _, offset := range shard.slotsAt(field+":"+node.value, limit-found, ts) {
+			hits = append(hits, rangeHit{node.value, shard, offset})
+			found++
+		}
+	}
+	return hits
+}
+
+// reads up to limit records of the range index with values from..to ordered by the value.
+// Every shard is asked for limit records under its lock, the records are read without the locks
+func (m *ConcurrentMap) findRangeAt(field, from, to string, bounded bool, limit int, ts uint64) ([][]byte, error) {
+	// the data files are not replaced until the records are read
+	for _, shard := range m.Shared {
+		shard.fileMx.RLock()
+		defer shard.fileMx.RUnlock()
+	}
+	hits := make([]rangeHit, 0)
+	for _, shard := range m.Shared {
+		shard.RLock()
+		hits = shard.rangeAt(field, from, to, bounded, limit, ts, hits)
+		shard.RUnlock()
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].value < hits[j].value })
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	results := make([][]byte, 0, len(hits))
+	for i := range hits {
+		data, err := m.ReadAtOffset(hits[i].shard, &hits[i].offset)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, data)
+	}
+	return results, nil
+}
+
+// encodes the bounds of a range query over the index whose values are of the kind, a nil bound is open
+func rangeBounds(kind byte, from, to interface{}) (string, string, bool, error) {
+	fromValue, toValue := RANGE_MARKER, ""
+	var err error
+	if from != nil {
+		fromValue, err = rangeOperand(kind, OP_GTE, from)
+		if err != nil {
+			return "", "", false, err
+		}
+	}
+	if to != nil {
+		toValue, err = rangeOperand(kind, OP_LTE, to)
+		if err != nil {
+			return "", "", false, err
+		}
+	}
+	return fromValue, toValue, to != nil, nil
+}
+
+// returns up to limit records whose range index (see RangeIndex) has a value between from and to
+// (both inclusive, nil means unbounded), ordered by the value. Numbers are compared with the values
+// of the index whatever their type is
+func (c *Collection) ScanRange(field string, from, to interface{}, limit int) ([][]byte, error) {
+	c.layout.enter()
+	defer c.layout.leave()
+	fromValue, toValue, bounded, err := rangeBounds(c.Map.rangeKind(field), from, to)
+	if err != nil {
+		return nil, err
+	}
+	return c.Map.findRangeAt(field, fromValue, toValue, bounded, limit, latest)
+}
+
+// same as Collection.ScanRange, but the records are read as of the time the snapshot was taken
+func (s *Snapshot) ScanRange(c *Collection, field string, from, to interface{}, limit int) ([][]byte, error) {
+	err := s.check(c)
+	if err != nil {
+		return nil, err
+	}
+	c.layout.enter()
+	defer c.layout.leave()
+	fromValue, toValue, bounded, err := rangeBounds(c.Map.rangeKind(field), from, to)
+	if err != nil {
+		return nil, err
+	}
+	return c.Map.findRangeAt(field, fromValue, toValue, bounded, limit, s.ts)
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Every record in a shard data file is prefixed with a header:
+// 4 bytes of the payload length and 4 bytes of the payload CRC32C (both little endian)
+const RECORD_HEADER_SIZE = 8
+
+var ErrCorruptedRecord = errors.New("record is corrupted")
+
+// wraps the payload into a record with a header
+func EncodeRecord(payload []byte) []byte {
+	record := make([]byte, RECORD_HEADER_SIZE+len(payload))
+	binary.LittleEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[RECORD_HEADER_SIZE:], payload)
+	return record
+}
+
+// validates the record and returns its payload
+func DecodeRecord(record []byte) ([]byte, error) {
+	if len(record) < RECORD_HEADER_SIZE {
+		return nil, ErrCorruptedRecord
+	}
+	length, checksum := parseRecordHeader(record)
+	payload := record[RECORD_HEADER_SIZE:]
+	if int(length) != len(payload) || crc32.Checksum(payload, crcTable) != checksum {
+		return nil, ErrCorruptedRecord
+	}
+	return payload, nil
+}
+
+func parseRecordHeader(header []byte) (length uint32, checksum uint32) {
+	return binary.LittleEndian.Uint32(header[:4]), binary.LittleEndian.Uint32(header[4:8])
+}
+
+// Walks through the records of a data file in order. A record that failed the validation is passed
+// with ErrCorruptedRecord, if its length can not be trusted the rest of the file is passed as one record
+func scanRecords(r io.ReaderAt, size int64, fn func(offset ShardOffset, payload []byte, err error) error) error {
+	reader := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	header := make([]byte, RECORD_HEADER_SIZE)
+	pos := int64(0)
+	for pos < size {
+		if size-pos < RECORD_HEADER_SIZE {
+			return fn(ShardOffset{Start: pos, Length: int(size - pos)}, nil, ErrCorruptedRecord)
+		}
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return err
+		}
+		length, checksum := parseRecordHeader(header)
+		total := int64(RECORD_HEADER_SIZE) + int64(length)
+		if pos+total > size {
+			// the length is damaged or the tail of the file is torn
+			return fn(ShardOffset{Start: pos, Length: int(size - pos)}, nil, ErrCorruptedRecord)
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return err
+		}
+		var recordErr error
+		if crc32.Checksum(payload, crcTable) != checksum {
+			payload, recordErr = nil, ErrCorruptedRecord
+		}
+		err = fn(ShardOffset{Start: pos, Length: int(total)}, payload, recordErr)
+		if err != nil {
+			return err
+		}
+		pos += total
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+)
+
+// compression of every record of a collection
+const (
+	COMPRESSION_NONE = iota
+	COMPRESSION_GZIP
+)
+
+// How the records of a collection are stored in the data files, chosen when the collection is created
+type recordFormat struct {
+	// name of the codec (see RegisterCodec)
+	name        string
+	codec       Codec
+	compression int
+}
+
+func newRecordFormat(name string, compression int) (*recordFormat, error) {
+	if name == "" {
+		name = CODEC_GOB
+	}
+	codec, ok := lookupCodec(name)
+	if !ok {
+		return nil, errors.New("unsupported codec " + name)
+	}
+	if compression != COMPRESSION_NONE && compression != COMPRESSION_GZIP {
+		return nil, errors.New("unsupported compression")
+	}
+	return &recordFormat{name, codec, compression}, nil
+}
+
+func (f *recordFormat) encode(e Element) ([]byte, error) {
+	data, err := f.codec.Encode(&e)
+	if err != nil {
+		return nil, err
+	}
+	if f.compression == COMPRESSION_GZIP {
+		var buf bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		_, err = w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	return data, nil
+}
+
+func (f *recordFormat) decode(data []byte) (*Element, error) {
+	if f.compression == COMPRESSION_GZIP {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f.codec.Decode(data)
+}
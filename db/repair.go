@@ -0,0 +1,121 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// Rebuilds Items and Capacities of the shard from its data file. Every record is an Element
+// with a CustomStructure payload, so its keys are restored through GetDataIndex.
+// Payload types have to be registered beforehand, corrupted records are skipped.
+// Deletion marks exist only in the metadata, so the soft deleted records become alive again
+// unless the deletion is still present in the write-ahead log. Records are appended, so
+// the last version of an updated record wins.
+// Returns the number of the restored records
+func (shard *ConcurrentMapShared) Rebuild() (int, error) {
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+
+	fi, err := shard.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	shard.Items = make(map[string]*ShardOffset)
+	shard.ranges = nil
+	shard.fields = nil
+	shard.Capacities = make(map[string]int)
+	shard.deadBytes = 0
+	// the whole write-ahead log has to be replayed against the rebuilt shard
+	shard.Seq = 0
+
+	counter := 0
+	// id -> keys of the last version of the record
+	versions := make(map[string][]string)
+	err = scanRecords(shard.file, fi.Size(), func(offset ShardOffset, payload []byte, err error) error {
+		if err != nil {
+			return nil
+		}
+		e, err := shard.format.decode(payload)
+		if err != nil {
+			return errors.New("failed to decode the record at " + ShardDataName(shard.Id) + " due " + err.Error())
+		}
+		structure, ok := e.Payload.(CustomStructure)
+		if !ok {
+			return errors.New("record " + e.Id + " does not implement CustomStructure")
+		}
+		if oldKeys, ok := versions[e.Id]; ok {
+			old := shard.Items["id:"+e.Id]
+			for _, key := range oldKeys {
+				if shard.Items[key] == old {
+					delete(shard.Items, key)
+				}
+			}
+			counter--
+		}
+		keys, _ := shard.recordKeys(e.Id, structure.GetDataIndex(), false)
+		record := offset
+		shard.insert(&record, keys)
+		versions[e.Id] = keys
+		counter++
+		return nil
+	})
+	return counter, err
+}
+
+// Rebuilds the index of the shard from its data file (see ConcurrentMapShared.Rebuild)
+func (c *Collection) RebuildShardIndex(n int) (int, error) {
+	c.layout.enter()
+	defer c.layout.leave()
+	if n < 0 || n >= len(c.Map.Shared) {
+		return 0, errors.New("invalid shard number")
+	}
+	counter, err := c.Map.Shared[n].Rebuild()
+	if err != nil {
+		return counter, err
+	}
+	c.rebuildDestinations()
+	c.Map.rebuildUniques()
+	atomic.StoreInt64(&c.ObjectsCounter, c.Map.CountAlive())
+	return counter, nil
+}
+
+// recalculates the shard destination of every key
+func (c *Collection) rebuildDestinations() {
+	dests := make(map[string]*int)
+	if c.Options.Placement == PLACEMENT_ROUND_ROBIN {
+		for _, shard := range c.Map.Shared {
+			shard.RLock()
+			for key := range shard.Items {
+				dests[key] = &shard.Id
+			}
+			shard.RUnlock()
+		}
+	}
+	c.sharedDestMx.Lock()
+	c.ShardDestinations = dests
+	c.sharedDestMx.Unlock()
+}
+
+// guesses the placement mode of a collection whose description is lost:
+// the hash placement is assumed if every record is stored in the shard derived from its id
+func (cm *ConcurrentMap) detectPlacement() int {
+	found := false
+	for _, shard := range cm.Shared {
+		shard.RLock()
+		for key, item := range shard.Items {
+			if strings.HasPrefix(key, "id:") {
+				if cm.GetShard(item.id) != shard {
+					shard.RUnlock()
+					return PLACEMENT_ROUND_ROBIN
+				}
+				found = true
+			}
+		}
+		shard.RUnlock()
+	}
+	if found {
+		return PLACEMENT_HASH
+	}
+	return PLACEMENT_ROUND_ROBIN
+}
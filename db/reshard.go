@@ -0,0 +1,494 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Keeps the shards of a collection in place while its operations are in progress (see Reshard).
+// Unlike sync.RWMutex, the state is kept per collection without the goroutines in mind, so an operation
+// must not enter again while it is inside. A waiting switch holds the new operations off, so it gets
+// its turn once the operations in progress leave
+type layoutLock struct {
+	mx     sync.Mutex
+	cond   *sync.Cond
+	active int
+	// number of the switches waiting for the operations in progress
+	pending   int
+	switching bool
+}
+
+// must be called under l.mx
+func (l *layoutLock) wait() {
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mx)
+	}
+	l.cond.Wait()
+}
+
+func (l *layoutLock) enter() {
+	l.mx.Lock()
+	for l.switching || l.pending > 0 {
+		l.wait()
+	}
+	l.active++
+	l.mx.Unlock()
+}
+
+func (l *layoutLock) leave() {
+	l.mx.Lock()
+	l.active--
+	if l.active == 0 && l.cond != nil {
+		l.cond.Broadcast()
+	}
+	l.mx.Unlock()
+}
+
+// waits for the operations in progress, the new ones wait for unlock
+func (l *layoutLock) lock() {
+	l.mx.Lock()
+	l.pending++
+	for l.switching || l.active > 0 {
+		l.wait()
+	}
+	l.pending--
+	l.switching = true
+	l.mx.Unlock()
+}
+
+func (l *layoutLock) unlock() {
+	l.mx.Lock()
+	l.switching = false
+	if l.cond != nil {
+		l.cond.Broadcast()
+	}
+	l.mx.Unlock()
+}
+
+// returns the current shards of the collection
+func (c *Collection) shards() []*ConcurrentMapShared {
+	c.layout.enter()
+	defer c.layout.leave()
+	return c.Map.Shared
+}
+
+// reports whether the shard was not replaced by Reshard
+func (c *Collection) ownsShard(shard *ConcurrentMapShared) bool {
+	c.layout.enter()
+	defer c.layout.leave()
+	return shard.Id < len(c.Map.Shared) && c.Map.Shared[shard.Id] == shard
+}
+
+// location of a record in the new layout
+type reshardTarget struct {
+	shard int
+	start int64
+}
+
+// data files of the new layout being written
+type reshardOutput struct {
+	files   []*os.File
+	writers []*bufio.Writer
+	sizes   []int64
+	// id of the record -> its new shard, the versions of a record are kept together
+	owners  map[string]int
+	counter int
+}
+
+func (out *reshardOutput) remove() {
+	for _, f := range out.files {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+}
+
+// copies the record of the old data file to the shard of the new layout it belongs to
+func (out *reshardOutput) copy(m *ConcurrentMap, src *os.File, item ShardOffset) (reshardTarget, error) {
+	n, ok := out.owners[item.id]
+	if !ok {
+		if m.placement == PLACEMENT_HASH {
+			n = int(uint(fnv32(item.id)) % uint(len(out.files)))
+		} else {
+			n = out.counter % len(out.files)
+			out.counter++
+		}
+		out.owners[item.id] = n
+	}
+	_, err := io.Copy(out.writers[n], io.NewSectionReader(src, item.Start, int64(item.Length)))
+	if err != nil {
+		return reshardTarget{}, err
+	}
+	target := reshardTarget{n, out.sizes[n]}
+	out.sizes[n] += int64(item.Length)
+	return target, nil
+}
+
+var ErrReshardStopped = errors.New("resharding was stopped")
+
+// interval between the attempts of a resharding postponed by the open snapshots, unless another one is given
+const RESHARD_RETRY_INTERVAL = time.Second
+
+// Progress of a resharding (see Collection.Reshard)
+type ReshardStats struct {
+	Running bool `json:"running"`
+	// number of the shards the records are moved into
+	ShardCount int `json:"shards"`
+	// records copied by the current attempt out of the records the collection had when it started
+	Copied int `json:"copied"`
+	Total  int `json:"total"`
+	// attempts postponed because snapshots or cursors were open
+	Retries   int    `json:"retries"`
+	LastError string `json:"last_error"`
+}
+
+// A resharding running in the background
+type Resharding struct {
+	collection *Collection
+	count      int
+	interval   time.Duration
+	stop       chan struct{}
+	done       chan struct{}
+	err        error
+
+	mx      sync.Mutex
+	stopped bool
+	stats   ReshardStats
+}
+
+// Moves the records of the collection into a new set of count shards in the background. The records are copied
+// into a new generation of the data files (see Manifest) while the collection stays readable and writable.
+// Then the operations in progress are waited for, the records changed in the meantime are copied and
+// the collection switches to the new files together with its metadata, the old files are removed.
+// Deleted records are moved as well, so they still can be restored. Like the compaction, the resharding
+// is postponed while snapshots (or cursors) are open, it is attempted again every retryInterval
+// (RESHARD_RETRY_INTERVAL if 0) until it succeeds, fails or is stopped
+func (c *Collection) Reshard(count int, retryInterval time.Duration) (*Resharding, error) {
+	if count <= 0 {
+		return nil, errors.New("invalid shard count")
+	}
+	if retryInterval <= 0 {
+		retryInterval = RESHARD_RETRY_INTERVAL
+	}
+	r := &Resharding{c, count, retryInterval, make(chan struct{}), make(chan struct{}), nil,
+		sync.Mutex{}, false, ReshardStats{Running: true, ShardCount: count}}
+	go r.run()
+	return r, nil
+}
+
+func (r *Resharding) run() {
+	defer close(r.done)
+	for {
+		err := r.collection.reshard(r)
+		if err != ErrSnapshotsOpen {
+			r.finish(err)
+			return
+		}
+		r.mx.Lock()
+		r.stats.Retries++
+		r.mx.Unlock()
+		timer := time.NewTimer(r.interval)
+		select {
+		case <-r.stop:
+			timer.Stop()
+			r.finish(ErrReshardStopped)
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *Resharding) finish(err error) {
+	r.mx.Lock()
+	r.stats.Running = false
+	if err != nil {
+		r.stats.LastError = err.Error()
+	}
+	r.err = err
+	r.mx.Unlock()
+}
+
+func (r *Resharding) Stats() ReshardStats {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.stats
+}
+
+// waits for the resharding to finish and returns its error
+func (r *Resharding) Wait() error {
+	<-r.done
+	return r.err
+}
+
+// interrupts the resharding, unless it is switching the shards already. Waits for it to exit and returns its error,
+// ErrReshardStopped if the collection kept its shards
+func (r *Resharding) Stop() error {
+	r.mx.Lock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.stop)
+	}
+	r.mx.Unlock()
+	return r.Wait()
+}
+
+func (r *Resharding) interrupted() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Resharding) begin(total int) {
+	r.mx.Lock()
+	r.stats.Copied, r.stats.Total = 0, total
+	r.mx.Unlock()
+}
+
+func (r *Resharding) copied() {
+	r.mx.Lock()
+	r.stats.Copied++
+	r.mx.Unlock()
+}
+
+// a single attempt of the resharding
+func (c *Collection) reshard(r *Resharding) error {
+	// the compactions of the old shards are held off until the end, another resharding waits here as well
+	var old []*ConcurrentMapShared
+	for {
+		old = c.shards()
+		for _, shard := range old {
+			shard.compactMx.Lock()
+		}
+		if c.ownsShard(old[0]) {
+			break
+		}
+		for _, shard := range old {
+			shard.compactMx.Unlock()
+		}
+	}
+	defer func() {
+		for _, shard := range old {
+			shard.compactMx.Unlock()
+		}
+	}()
+	if c.Map.clock.pinned() {
+		return ErrSnapshotsOpen
+	}
+
+	// the generation is kept from a concurrent Sync until it is committed
+	gen := c.manifest.Next()
+	defer c.manifest.Release(gen)
+	out := &reshardOutput{make([]*os.File, r.count), make([]*bufio.Writer, r.count), make([]int64, r.count), make(map[string]int), 0}
+	for i := range out.files {
+		f, err := os.OpenFile(c.manifest.PathOf(ShardDataName(i), gen), os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+		if err != nil {
+			out.remove()
+			return err
+		}
+		out.files[i] = f
+		out.writers[i] = bufio.NewWriterSize(f, COMPACTION_BUFFER_SIZE)
+	}
+
+	// copy the records, the deleted ones included
+	records := make([][]ShardOffset, len(old))
+	sources := make([]*os.File, len(old))
+	total := 0
+	for i, shard := range old {
+		shard.RLock()
+		records[i] = make([]ShardOffset, 0, len(shard.Items))
+		for key, item := range shard.Items {
+			if key == "id:"+item.id {
+				records[i] = append(records[i], *item)
+			}
+		}
+		// the data file is replaced only by the compaction, so it is safe to read it without the lock
+		sources[i] = shard.file
+		shard.RUnlock()
+		sortOffsets(records[i])
+		total += len(records[i])
+	}
+	r.begin(total)
+	moved := make([]map[int64]reshardTarget, len(old))
+	for i := range old {
+		moved[i] = make(map[int64]reshardTarget, len(records[i]))
+		for _, record := range records[i] {
+			if r.interrupted() {
+				out.remove()
+				return ErrReshardStopped
+			}
+			target, err := out.copy(c.Map, sources[i], record)
+			if err != nil {
+				out.remove()
+				return err
+			}
+			moved[i][record.Start] = target
+			r.copied()
+		}
+	}
+
+	c.syncMx.Lock()
+	defer c.syncMx.Unlock()
+	c.layout.lock()
+	defer c.layout.unlock()
+	for _, shard := range old {
+		shard.fileMx.Lock()
+		shard.Lock()
+	}
+	defer func() {
+		for _, shard := range old {
+			shard.Unlock()
+			shard.fileMx.Unlock()
+		}
+	}()
+	// snapshots taken from now on read the collection only after the switch
+	if c.Map.clock.pinned() {
+		out.remove()
+		return ErrSnapshotsOpen
+	}
+
+	shards, err := c.reshardLocked(old, moved, out)
+	if err != nil {
+		out.remove()
+		return err
+	}
+	return c.switchShards(old, shards, gen, out)
+}
+
+// builds the shards of the new layout from the old ones, the records written since they were copied
+// are copied now. The old shards must be locked
+func (c *Collection) reshardLocked(old []*ConcurrentMapShared, moved []map[int64]reshardTarget, out *reshardOutput) ([]*ConcurrentMapShared, error) {
+	count := len(out.files)
+	shards := make([]*ConcurrentMapShared, count)
+	// full key -> slots of the regular index in every new shard
+	slots := make([]map[string][]slotEntry, count)
+	seq := uint64(0)
+	for i := range shards {
+		shards[i] = NewConcurrentMapShared(c.SyncDestination, i, out.files[i])
+		shards[i].format = c.Map.format
+		slots[i] = make(map[string][]slotEntry)
+	}
+
+	for i, shard := range old {
+		if shard.Seq > seq {
+			seq = shard.Seq
+		}
+		items := make(map[*ShardOffset]*ShardOffset, len(shard.Items))
+		for key, item := range shard.Items {
+			record, ok := items[item]
+			if !ok {
+				target, ok := moved[i][item.Start]
+				if !ok {
+					// written or updated during the copy
+					var err error
+					target, err = out.copy(c.Map, shard.file, *item)
+					if err != nil {
+						return nil, err
+					}
+					moved[i][item.Start] = target
+				}
+				record = &ShardOffset{Start: target.start, Length: item.Length, Deleted: item.Deleted, id: item.id}
+				items[item] = record
+			}
+			target := moved[i][item.Start]
+			if n, fullKey, ok := splitSlotKey(key); ok {
+				slots[target.shard][fullKey] = append(slots[target.shard][fullKey], slotEntry{n, record})
+			} else {
+				shards[target.shard].Items[key] = record
+			}
+		}
+	}
+
+	for i, shard := range shards {
+		// slots of a regular index come from several old shards, so they are numbered anew
+		for fullKey, entries := range slots[i] {
+			sort.SliceStable(entries, func(a, b int) bool { return entries[a].n < entries[b].n })
+			for n, e := range entries {
+				shard.Items[strconv.Itoa(n)+":"+fullKey] = e.item
+			}
+			shard.SetCapacityKey(fullKey, len(entries)-1)
+		}
+		// every entry of the write-ahead log so far is a part of the new layout
+		shard.Seq = seq
+		err := out.writers[i].Flush()
+		if err == nil {
+			err = out.files[i].Sync()
+		}
+		if err != nil {
+			return nil, err
+		}
+		shard.relink()
+	}
+	return shards, nil
+}
+
+// makes the new shards current and commits them to the drive with the rest of the metadata,
+// the old shards are restored if that fails. The old shards must be locked
+func (c *Collection) switchShards(old, shards []*ConcurrentMapShared, gen uint64, out *reshardOutput) error {
+	// the entries of the old shards are checkpointed by the new metadata
+	walGen, err := c.Map.wal.Rotate()
+	if err != nil {
+		out.remove()
+		return err
+	}
+	dataNames := make([]string, 0, len(shards))
+	for i := range shards {
+		dataNames = append(dataNames, ShardDataName(i))
+	}
+	dropped := make([]string, 0)
+	stale := make([]string, 0)
+	for i := len(shards); i < len(old); i++ {
+		for _, name := range []string{ShardDataName(i), ShardMetaName(i)} {
+			dropped = append(dropped, name)
+			stale = append(stale, c.manifest.Path(name))
+		}
+	}
+
+	c.sharedDestMx.RLock()
+	dests := c.ShardDestinations
+	c.sharedDestMx.RUnlock()
+	c.Map.Shared = shards
+	c.Map.SetCounterIndex(0)
+	c.Options.ShardCount = len(shards)
+	c.rebuildDestinations()
+	names, err := c.Map.Sync(gen)
+	if err == nil {
+		var descriptor string
+		descriptor, err = c.saveDescriptor(gen)
+		names = append(append(names, dataNames...), descriptor)
+	}
+	if err == nil {
+		err = c.manifest.Replace(gen, names, dropped)
+	}
+	if err != nil {
+		c.Map.Shared = old
+		c.Map.SetCounterIndex(0)
+		c.Options.ShardCount = len(old)
+		c.sharedDestMx.Lock()
+		c.ShardDestinations = dests
+		c.sharedDestMx.Unlock()
+		out.remove()
+		return err
+	}
+
+	for _, shard := range old {
+		shard.file.Close()
+	}
+	for _, name := range stale {
+		os.Remove(name)
+	}
+	err = c.manifest.RemoveStale()
+	if err != nil {
+		return err
+	}
+	return c.Map.wal.Remove(walGen)
+}
@@ -2,7 +2,6 @@ package db
 
 import (
 	"errors"
-	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
@@ -16,8 +15,20 @@ type ConcurrentMapShared struct {
 	Items      map[string]*ShardOffset `json:"items"`
 	Capacities map[string]int          `json:"enum"`
 	file       *os.File                `json:"-"`
+	// sequence number of the last write-ahead log entry applied to the shard
+	Seq uint64 `json:"seq"`
 
-	mx sync.RWMutex // Read Write mutex, guards access to internal map.
+	mx        sync.RWMutex // Read Write mutex, guards access to internal map.
+	compactMx sync.Mutex   // only one compaction of the shard may run at a time
+	deadBytes int64        // size of the deleted records that are still in the data file
+	// the data file is not replaced (see compactShard) while it is read without the shard lock
+	fileMx  sync.RWMutex
+	history *shardHistory // versions of the records kept for the open snapshots
+	// field -> ordered values of the range index (see RangeIndex)
+	ranges map[string]*skipList
+	// names of the indexes the records of the shard are stored under
+	fields map[string]bool
+	format *recordFormat
 
 	SyncDestination string
 }
@@ -42,85 +53,345 @@ func (shard *ConcurrentMapShared) RUnlock() {
 	shard.mx.RUnlock()
 }
 
-func (shard *ConcurrentMapShared) Sync() error {
+func ShardDataName(id int) string {
+	return "shard_" + strconv.Itoa(id) + ".gobs"
+}
+
+func ShardMetaName(id int) string {
+	return "shard_" + strconv.Itoa(id) + "_meta.gob.gzip"
+}
+
+// saves the shard metadata under the given generation of the file (see Manifest)
+func (shard *ConcurrentMapShared) Sync(gen uint64) error {
 	shard.mx.RLock()
 	defer shard.mx.RUnlock()
-	p := NewEncodedCompressedPackage(shard.SyncDestination + "/shard_" + strconv.Itoa(shard.Id) + "_meta.gob.gzip")
+	return shard.save(gen)
+}
+
+// same as Sync, but the caller must hold the shard lock
+func (shard *ConcurrentMapShared) save(gen uint64) error {
+	p := NewEncodedCompressedPackage(shard.SyncDestination + "/" + generationName(ShardMetaName(shard.Id), gen))
 	p.SetData(shard)
 	return p.Save()
 }
 
-func (shard *ConcurrentMapShared) applyOffset(move, after int64) {
-	for _, item := range shard.Items {
-		if item.Start > after {
-			item.Start -= move
+// gob does not preserve pointers aliasing, so after loading every key of a record
+// refers to its own copy of the offset. Restores the sharing with the "id" key of the record
+func (shard *ConcurrentMapShared) relink() {
+	records := make(map[int64]*ShardOffset)
+	alive := int64(0)
+	for key, item := range shard.Items {
+		if strings.HasPrefix(key, "id:") {
+			item.id = key[3:]
+			records[item.Start] = item
+			if !item.Deleted {
+				alive += int64(item.Length)
+			}
 		}
 	}
-}
-
-func (shard *ConcurrentMapShared) adjustCapacity(key string) {
-	fullKey := "n:" + key
-	if item, ok := shard.Capacities[fullKey]; ok {
-		item--
-		if item <= 0 {
-			shard.DeleteCapacityKey(key)
-			return
+	for key, item := range shard.Items {
+		if record, ok := records[item.Start]; ok {
+			shard.Items[key] = record
+		}
+	}
+	shard.rebuildRanges()
+	// everything but the alive records is dead: deleted records and the old versions of the updated ones
+	shard.deadBytes = 0
+	if shard.file != nil {
+		if fi, err := shard.file.Stat(); err == nil && fi.Size() > alive {
+			shard.deadBytes = fi.Size() - alive
 		}
-		shard.Capacities[fullKey] = item
 	}
 }
 
-func (shard *ConcurrentMapShared) Optimize() (int64, error) {
-	shard.mx.Lock()
-	defer shard.mx.Unlock()
+// marks the record as deleted or alive and keeps track of the dead bytes, must be called under the shard lock
+func (shard *ConcurrentMapShared) setDeleted(item *ShardOffset, deleted bool) {
+	if item.Deleted == deleted {
+		return
+	}
+	item.Deleted = deleted
+	if deleted {
+		shard.deadBytes += int64(item.Length)
+	} else {
+		shard.deadBytes -= int64(item.Length)
+	}
+}
 
+// returns the size of the data file and the size of the deleted records in it
+func (shard *ConcurrentMapShared) Space() (size int64, dead int64, err error) {
+	shard.mx.RLock()
+	defer shard.mx.RUnlock()
 	fi, err := shard.file.Stat()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
+	return fi.Size(), shard.deadBytes, nil
+}
 
-	_, err = shard.file.Seek(0, 0)
+// appends the payload to the end of the data file, must be called under the shard lock.
+// Returns the location and the encoded record
+func (shard *ConcurrentMapShared) appendRecord(payload []byte) (ShardOffset, []byte, error) {
+	ret, err := shard.file.Seek(0, 2)
+	if err != nil {
+		return ShardOffset{}, nil, err
+	}
+	record := EncodeRecord(payload)
+	n, err := shard.file.Write(record)
 	if err != nil {
-		return 0, err
+		return ShardOffset{}, nil, err
 	}
+	return ShardOffset{Start: ret, Length: n}, record, nil
+}
 
-	// load the whole shard into the memory
-	shardData := make([]byte, fi.Size())
-	_, err = shard.file.Read(shardData)
+// reads and decodes the record, must be called under the shard lock
+func (shard *ConcurrentMapShared) readElement(item *ShardOffset) (*Element, error) {
+	data := make([]byte, item.Length)
+	_, err := shard.file.ReadAt(data, item.Start)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := DecodeRecord(data)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	// closing the file and flushing the data
-	shard.file.Close()
-	buffer := NewSuperBuffer(shardData)
+	return shard.format.decode(payload)
+}
 
-	// redistribute the data
-	pos := 0
-	counter := int64(0)
-	for key, item := range shard.Items {
-		if item.Deleted {
-			buffer.Cut(item.Start, item.Length)
-			shard.applyOffset(int64(item.Length), item.Start)
-			// adjust the capacity of a set
-			pos = strings.Index(key, ":")
-			if pos >= 0 {
-				shard.adjustCapacity(key[pos+1:])
+// calls fn for every occupied slot of the regular index until it returns false, must be called under the shard lock
+func (shard *ConcurrentMapShared) eachSlot(fullKey string, fn func(key string, item *ShardOffset) bool) {
+	capacity := shard.GetCapacityKey(fullKey)
+	for i := 0; i <= capacity; i++ {
+		key := strconv.Itoa(i) + ":" + fullKey
+		if item, ok := shard.Items[key]; ok && !fn(key, item) {
+			return
+		}
+	}
+}
+
+// returns all of the keys the record (e is its decoded content) is stored under. Keys are not kept per record,
+// so they are restored from the index data of the payload, must be called under the shard lock
+func (shard *ConcurrentMapShared) keysOf(e *Element, item *ShardOffset) ([]string, error) {
+	structure, ok := e.Payload.(CustomStructure)
+	if !ok {
+		return nil, errors.New("record " + e.Id + " does not implement CustomStructure")
+	}
+	keys := make([]string, 0)
+	for _, ix := range structure.GetDataIndex() {
+		fullKey := ix.Field + ":" + ix.Data
+		if ix.Unique {
+			if shard.Items[fullKey] == item {
+				keys = append(keys, fullKey)
 			}
+			continue
+		}
+		shard.eachSlot(fullKey, func(key string, slot *ShardOffset) bool {
+			if slot == item {
+				keys = append(keys, key)
+			}
+			return true
+		})
+	}
+	return append(keys, "id:"+e.Id), nil
+}
+
+// returns the keys of the new version of the record (the "id" key is the last one) and the old keys it loses.
+// Slots of the regular indexes whose value has not changed are kept
+func (shard *ConcurrentMapShared) updatedKeys(id string, oldKeys []string, indexData []*FullDataIndex) (keys []string, removed []string) {
+	// full key -> slot of the old version
+	slots := make(map[string]string)
+	for _, key := range oldKeys {
+		if _, fullKey, ok := splitSlotKey(key); ok {
+			slots[fullKey] = key
+		}
+	}
+	keys = make([]string, 0, len(indexData)+1)
+	for _, ix := range indexData {
+		if ix.Data == "" {
+			continue
+		}
+		fullKey := ix.Field + ":" + ix.Data
+		if ix.Unique {
+			keys = append(keys, fullKey)
+		} else if slot, ok := slots[fullKey]; ok {
+			keys = append(keys, slot)
+			delete(slots, fullKey)
+		} else {
+			keys = append(keys, shard.nextSlotKey(fullKey))
+		}
+	}
+	keys = append(keys, "id:"+id)
+	kept := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		kept[key] = true
+	}
+	for _, key := range oldKeys {
+		if !kept[key] {
+			removed = append(removed, key)
+		}
+	}
+	return keys, removed
+}
+
+// moves the record to its new version, must be called under the shard lock
+func (shard *ConcurrentMapShared) replace(old *ShardOffset, offset *ShardOffset, removed []string, keys []string) {
+	for _, key := range removed {
+		if shard.Items[key] == old {
 			delete(shard.Items, key)
-			counter += int64(item.Length)
 		}
 	}
+	shard.insert(offset, keys)
+	shard.deadBytes += int64(old.Length)
+}
 
-	fName := shard.SyncDestination + "/" + fi.Name()
-	err = ioutil.WriteFile(fName, buffer.Bytes(), os.ModePerm)
-	if err != nil {
-		return 0, err
+// returns the first free key of a regular (not unique) index
+func (shard *ConcurrentMapShared) nextSlotKey(fullKey string) string {
+	index := shard.GetCapacityKey(fullKey)
+	for {
+		key := strconv.Itoa(index) + ":" + fullKey
+		if _, ok := shard.Items[key]; !ok {
+			return key
+		}
+		index++
+	}
+}
+
+// returns the keys the record is going to be stored under, the "id" key is always the last one
+func (shard *ConcurrentMapShared) recordKeys(id string, indexData []*FullDataIndex, checkUnique bool) ([]string, error) {
+	keys := make([]string, 0, len(indexData)+1)
+	for _, ix := range indexData {
+		// an index without a value (e.g. an incomplete composite one) is not stored
+		if ix.Data == "" {
+			continue
+		}
+		fullKey := ix.Field + ":" + ix.Data
+		// Unique index key
+		if ix.Unique {
+			if _, ok := shard.Items[fullKey]; ok && checkUnique {
+				return nil, &ErrDuplicateKey{ix.Field, ix.Data}
+			}
+			keys = append(keys, fullKey)
+		} else {
+			// Regular key
+			keys = append(keys, shard.nextSlotKey(fullKey))
+		}
+	}
+	return append(keys, "id:"+id), nil
+}
+
+// puts the record under all of its keys and extends the capacity of the regular indexes
+func (shard *ConcurrentMapShared) insert(offset *ShardOffset, keys []string) {
+	for _, key := range keys {
+		shard.Items[key] = offset
+		if strings.HasPrefix(key, "id:") {
+			offset.id = key[3:]
+			continue
+		}
+		if n, fullKey, ok := splitSlotKey(key); ok {
+			if n >= shard.GetCapacityKey(fullKey) {
+				shard.SetCapacityKey(fullKey, n)
+			}
+			shard.addRange(fullKey)
+			shard.addField(fullKey)
+		} else {
+			shard.addField(key)
+		}
+	}
+}
+
+// indexes of the shard a record is going to be added under, kept to undo the change (see shardChange.undo)
+type indexState struct {
+	// full key of a regular index -> its capacity before the change, -1 if it had none
+	capacities map[string]int
+	// full keys of the range values the shard did not have
+	ranges []string
+	// names of the indexes the shard did not have
+	fields []string
+}
+
+// returns the state of the indexes the keys are going to change (see insert), must be called under the shard lock
+func (shard *ConcurrentMapShared) indexStateOf(keys []string) *indexState {
+	s := &indexState{make(map[string]int), nil, nil}
+	fields := make(map[string]bool)
+	for _, key := range keys {
+		if strings.HasPrefix(key, "id:") {
+			continue
+		}
+		fullKey := key
+		if _, slotFullKey, ok := splitSlotKey(key); ok {
+			fullKey = slotFullKey
+			if _, ok := s.capacities[fullKey]; !ok {
+				s.capacities[fullKey] = -1
+				if n, ok := shard.Capacities["n:"+fullKey]; ok {
+					s.capacities[fullKey] = n
+				}
+			}
+			if field, value, ok := splitRangeKey(fullKey); ok {
+				var node *skipNode
+				if values, ok := shard.ranges[field]; ok {
+					node = values.seek(value)
+				}
+				if node == nil || node.value != value {
+					s.ranges = append(s.ranges, fullKey)
+				}
+			}
+		}
+		if pos := strings.Index(fullKey, ":"); pos >= 0 {
+			field := fullKey[:pos]
+			if !shard.fields[field] && !fields[field] {
+				fields[field] = true
+				s.fields = append(s.fields, field)
+			}
+		}
 	}
+	return s
+}
 
-	shardData = nil
-	buffer = nil
-	shard.file, err = os.OpenFile(fName, os.O_RDWR, os.ModePerm)
-	return counter, err
+// brings the indexes back to the state before the change (see indexStateOf), must be called under the shard lock
+func (shard *ConcurrentMapShared) restoreIndexes(s *indexState) {
+	for fullKey, n := range s.capacities {
+		if n < 0 {
+			shard.DeleteCapacityKey(fullKey)
+		} else {
+			shard.SetCapacityKey(fullKey, n)
+		}
+	}
+	for _, fullKey := range s.ranges {
+		field, value, _ := splitRangeKey(fullKey)
+		if values, ok := shard.ranges[field]; ok {
+			values.remove(value)
+			if values.length == 0 {
+				delete(shard.ranges, field)
+			}
+		}
+	}
+	for _, field := range s.fields {
+		delete(shard.fields, field)
+	}
+}
+
+// remembers the name of the index of the full key, must be called under the shard lock
+func (shard *ConcurrentMapShared) addField(fullKey string) {
+	pos := strings.Index(fullKey, ":")
+	if pos < 0 {
+		return
+	}
+	if shard.fields == nil {
+		shard.fields = make(map[string]bool)
+	}
+	shard.fields[fullKey[:pos]] = true
+}
+
+// splits a key of a regular index ("<slot>:<field>:<value>") into the slot number and the rest of the key
+func splitSlotKey(key string) (int, string, bool) {
+	pos := strings.Index(key, ":")
+	if pos < 0 {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(key[:pos])
+	if err != nil {
+		return 0, "", false
+	}
+	return n, key[pos+1:], true
 }
 
 //! Not intended to be used in production environment
@@ -0,0 +1,127 @@
+package db
+
+import "math/rand"
+
+const SKIPLIST_MAX_LEVEL = 24
+
+type skipNode struct {
+	value string
+	next  []*skipNode
+	// the preceding node of the lowest level, the head for the first node
+	prev *skipNode
+}
+
+// An ordered set of strings
+type skipList struct {
+	head   *skipNode
+	level  int
+	length int
+}
+
+func newSkipList() *skipList {
+	return &skipList{&skipNode{"", make([]*skipNode, SKIPLIST_MAX_LEVEL), nil}, 1, 0}
+}
+
+func randomSkipLevel() int {
+	level := 1
+	for level < SKIPLIST_MAX_LEVEL && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// returns the last node of every level that precedes the value
+func (l *skipList) path(value string) []*skipNode {
+	update := make([]*skipNode, SKIPLIST_MAX_LEVEL)
+	node := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].value < value {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+// adds the value, returns false if it is already in the list
+func (l *skipList) insert(value string) bool {
+	update := l.path(value)
+	if next := update[0].next[0]; next != nil && next.value == value {
+		return false
+	}
+	level := randomSkipLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			update[i] = l.head
+		}
+		l.level = level
+	}
+	node := &skipNode{value, make([]*skipNode, level), update[0]}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	if next := node.next[0]; next != nil {
+		next.prev = node
+	}
+	l.length++
+	return true
+}
+
+// removes the value, returns false if it is not in the list
+func (l *skipList) remove(value string) bool {
+	update := l.path(value)
+	node := update[0].next[0]
+	if node == nil || node.value != value {
+		return false
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	if next := node.next[0]; next != nil {
+		next.prev = node.prev
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.length--
+	return true
+}
+
+// returns the first node with a value not less than from
+func (l *skipList) seek(from string) *skipNode {
+	return l.path(from)[0].next[0]
+}
+
+// returns the last node with a value not greater than to
+func (l *skipList) seekBack(to string) *skipNode {
+	node := l.path(to)[0]
+	if next := node.next[0]; next != nil && next.value == to {
+		return next
+	}
+	return l.node(node)
+}
+
+// returns the last node of the list
+func (l *skipList) last() *skipNode {
+	node := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil {
+			node = node.next[i]
+		}
+	}
+	return l.node(node)
+}
+
+// returns the node preceding the node, nil for the first one
+func (l *skipList) prev(node *skipNode) *skipNode {
+	return l.node(node.prev)
+}
+
+// the head of the list is not a node of a value
+func (l *skipList) node(n *skipNode) *skipNode {
+	if n == l.head {
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,381 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// read timestamp of the current state of the shards
+const latest = ^uint64(0)
+
+var ErrSnapshotClosed = errors.New("snapshot is closed")
+
+var errNotFound = errors.New("not found")
+
+// Returned by the compaction and Collection.Reshard while snapshots are open, they can be retried once the snapshots are closed
+var ErrSnapshotsOpen = errors.New("data files are not rewritten while snapshots are open")
+
+// Orders the changes of the shards against the snapshots. Every change is stamped with the current time,
+// a snapshot sees the changes stamped up to its read timestamp. Writers hold mx shared while they change the shards,
+// a snapshot takes it exclusively, so it never sees half of a change (or of a transaction)
+type snapshotClock struct {
+	mx  sync.RWMutex
+	now uint64
+
+	// read timestamp -> number of the open snapshots
+	open   map[uint64]int
+	openMx sync.Mutex
+}
+
+func newSnapshotClock() *snapshotClock {
+	return &snapshotClock{sync.RWMutex{}, 0, make(map[uint64]int), sync.Mutex{}}
+}
+
+// time of a change and whether the versions it replaces have to be kept for the open snapshots
+type stamp struct {
+	ts   uint64
+	keep bool
+	// versions replaced before this time are not visible to any snapshot
+	oldest uint64
+}
+
+// starts a change of the shards, done must be called once the change is applied
+func (cl *snapshotClock) write() stamp {
+	cl.mx.RLock()
+	// snapshots can not be opened while the lock is held, so nothing below changes but the closing ones
+	oldest, keep := cl.oldest()
+	return stamp{cl.now, keep, oldest}
+}
+
+func (cl *snapshotClock) done() {
+	cl.mx.RUnlock()
+}
+
+// returns the read timestamp of a new snapshot
+func (cl *snapshotClock) openSnapshot() uint64 {
+	cl.mx.Lock()
+	ts := cl.now
+	cl.now++
+	cl.openMx.Lock()
+	cl.open[ts]++
+	cl.openMx.Unlock()
+	cl.mx.Unlock()
+	return ts
+}
+
+func (cl *snapshotClock) closeSnapshot(ts uint64) {
+	cl.openMx.Lock()
+	cl.open[ts]--
+	if cl.open[ts] <= 0 {
+		delete(cl.open, ts)
+	}
+	cl.openMx.Unlock()
+}
+
+// returns the read timestamp of the oldest open snapshot
+func (cl *snapshotClock) oldest() (uint64, bool) {
+	cl.openMx.Lock()
+	defer cl.openMx.Unlock()
+	oldest, ok := latest, false
+	for ts := range cl.open {
+		if ts < oldest {
+			oldest, ok = ts, true
+		}
+	}
+	return oldest, ok
+}
+
+// reports whether any snapshot is open
+func (cl *snapshotClock) pinned() bool {
+	_, ok := cl.oldest()
+	return ok
+}
+
+// versions of the records of a shard replaced while snapshots were open
+type shardHistory struct {
+	// key -> records it referred to before
+	retired map[string][]retiredKey
+	// record -> its deletion marks before the flips
+	flips map[*ShardOffset][]deletedFlip
+}
+
+type retiredKey struct {
+	item *ShardOffset
+	at   uint64
+}
+
+type deletedFlip struct {
+	at      uint64
+	deleted bool
+}
+
+func newShardHistory() *shardHistory {
+	return &shardHistory{make(map[string][]retiredKey), make(map[*ShardOffset][]deletedFlip)}
+}
+
+// locks the shard for a change, the returned stamp has to be passed to the changes made under the lock
+func (m *ConcurrentMap) lockShard(shard *ConcurrentMapShared) stamp {
+	st := m.clock.write()
+	shard.Lock()
+	shard.forget(st)
+	return st
+}
+
+func (m *ConcurrentMap) unlockShard(shard *ConcurrentMapShared) {
+	shard.Unlock()
+	m.clock.done()
+}
+
+// drops the history once no snapshot is open, must be called under the shard lock
+func (shard *ConcurrentMapShared) forget(st stamp) {
+	if !st.keep {
+		shard.history = nil
+	}
+}
+
+// keeps the record under its keys for the snapshots older than the change, must be called under the shard lock
+func (shard *ConcurrentMapShared) retire(item *ShardOffset, keys []string, st stamp) {
+	if !st.keep {
+		return
+	}
+	if shard.history == nil {
+		shard.history = newShardHistory()
+	}
+	for _, key := range keys {
+		versions := make([]retiredKey, 0, 1)
+		for _, r := range shard.history.retired[key] {
+			if r.at > st.oldest {
+				versions = append(versions, r)
+			}
+		}
+		shard.history.retired[key] = append(versions, retiredKey{item, st.ts})
+	}
+}
+
+// marks the record as deleted or alive, the previous mark is kept for the snapshots older than the change.
+// Must be called under the shard lock
+func (shard *ConcurrentMapShared) flip(item *ShardOffset, deleted bool, st stamp) {
+	if item.Deleted == deleted {
+		return
+	}
+	if st.keep {
+		if shard.history == nil {
+			shard.history = newShardHistory()
+		}
+		flips := make([]deletedFlip, 0, 1)
+		for _, f := range shard.history.flips[item] {
+			if f.at > st.oldest {
+				flips = append(flips, f)
+			}
+		}
+		shard.history.flips[item] = append(flips, deletedFlip{st.ts, item.Deleted})
+	}
+	shard.setDeleted(item, deleted)
+}
+
+// drops the versions of the record kept by retire and flip at the time of an undone change,
+// must be called under the shard lock
+func (shard *ConcurrentMapShared) unretire(item *ShardOffset, keys []string, at uint64) {
+	if shard.history == nil {
+		return
+	}
+	for _, key := range keys {
+		versions := shard.history.retired[key]
+		if n := len(versions); n > 0 && versions[n-1].item == item && versions[n-1].at == at {
+			versions = versions[:n-1]
+		}
+		if len(versions) == 0 {
+			delete(shard.history.retired, key)
+		} else {
+			shard.history.retired[key] = versions
+		}
+	}
+	flips := shard.history.flips[item]
+	if n := len(flips); n > 0 && flips[n-1].at == at {
+		flips = flips[:n-1]
+	}
+	if len(flips) == 0 {
+		delete(shard.history.flips, item)
+	} else {
+		shard.history.flips[item] = flips
+	}
+}
+
+// returns the record stored under the key at the read timestamp, must be called under the shard lock
+func (shard *ConcurrentMapShared) itemAt(key string, ts uint64) (*ShardOffset, bool) {
+	if shard.history != nil {
+		for _, r := range shard.history.retired[key] {
+			if r.item.created <= ts && ts < r.at {
+				return r.item, true
+			}
+		}
+	}
+	item, ok := shard.Items[key]
+	if !ok || item.created > ts {
+		return nil, false
+	}
+	return item, true
+}
+
+// returns the deletion mark of the record at the read timestamp, must be called under the shard lock
+func (shard *ConcurrentMapShared) deletedAt(item *ShardOffset, ts uint64) bool {
+	if shard.history != nil {
+		// the first flip after the timestamp keeps the mark the record had at that time
+		for _, f := range shard.history.flips[item] {
+			if f.at > ts {
+				return f.deleted
+			}
+		}
+	}
+	return item.Deleted
+}
+
+// returns the alive record under the unique key at the read timestamp, must be called under the shard lock
+func (shard *ConcurrentMapShared) uniqueAt(fullKey string, ts uint64) (ShardOffset, bool) {
+	item, ok := shard.itemAt(fullKey, ts)
+	if !ok || shard.deletedAt(item, ts) {
+		return ShardOffset{}, false
+	}
+	return *item, true
+}
+
+// returns up to limit alive records of the regular index at the read timestamp, must be called under the shard lock
+func (shard *ConcurrentMapShared) slotsAt(fullKey string, limit int, ts uint64) []ShardOffset {
+	offsets := make([]ShardOffset, 0)
+	// the capacity only grows, so it covers every slot the index had before
+	capacity := shard.GetCapacityKey(fullKey)
+	for i := 0; i <= capacity && len(offsets) < limit; i++ {
+		item, ok := shard.itemAt(strconv.Itoa(i)+":"+fullKey, ts)
+		if ok && !shard.deletedAt(item, ts) {
+			offsets = append(offsets, *item)
+		}
+	}
+	return offsets
+}
+
+// reads the record under the unique key at the read timestamp. The shard lock is held only to find the record,
+// so the writers are not blocked by the drive
+func (m *ConcurrentMap) findUniqueAt(shard *ConcurrentMapShared, fullKey string, ts uint64) ([]byte, error) {
+	shard.fileMx.RLock()
+	defer shard.fileMx.RUnlock()
+	shard.RLock()
+	offset, ok := shard.uniqueAt(fullKey, ts)
+	shard.RUnlock()
+	if !ok {
+		return nil, errNotFound
+	}
+	return m.ReadAtOffset(shard, &offset)
+}
+
+// reads up to limit records of the regular index of the shard at the read timestamp (see findUniqueAt)
+func (m *ConcurrentMap) findInShardAt(shard *ConcurrentMapShared, kv string, limit int, ts uint64, results [][]byte) ([][]byte, error) {
+	shard.fileMx.RLock()
+	defer shard.fileMx.RUnlock()
+	shard.RLock()
+	offsets := shard.slotsAt(kv, limit-len(results), ts)
+	shard.RUnlock()
+	for i := range offsets {
+		data, err := m.ReadAtOffset(shard, &offsets[i])
+		if err != nil {
+			return results, err
+		}
+		results = append(results, data)
+	}
+	return results, nil
+}
+
+// reads up to limit records of the regular index across the shards at the read timestamp
+func (m *ConcurrentMap) findByKeyAt(kv string, limit int, ts uint64) ([][]byte, error) {
+	results := make([][]byte, 0, limit)
+	var err error
+	for _, shard := range m.Shared {
+		results, err = m.findInShardAt(shard, kv, limit, ts, results)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) == limit {
+			break
+		}
+	}
+	return results, nil
+}
+
+// A consistent point-in-time view of all of the collections of the database. Reads of the snapshot
+// see neither the changes made after it was taken nor a part of a transaction, and never block the writers.
+// Replaced versions of the records are kept in memory and the compaction is postponed until the snapshot is closed
+type Snapshot struct {
+	clock  *snapshotClock
+	ts     uint64
+	closed bool
+	mx     sync.Mutex
+}
+
+func (db *Database) Snapshot() *Snapshot {
+	return &Snapshot{db.clock, db.clock.openSnapshot(), false, sync.Mutex{}}
+}
+
+// releases the versions kept for the snapshot
+func (s *Snapshot) Close() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.clock.closeSnapshot(s.ts)
+	}
+}
+
+func (s *Snapshot) check(c *Collection) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return ErrSnapshotClosed
+	}
+	if c == nil || c.Map.clock != s.clock {
+		return errors.New("collection does not belong to the database of the snapshot")
+	}
+	return nil
+}
+
+func (s *Snapshot) FindById(c *Collection, id string) ([]byte, error) {
+	err := s.check(c)
+	if err != nil {
+		return nil, err
+	}
+	c.layout.enter()
+	defer c.layout.leave()
+	// records never leave their shard
+	shard, err := c.getShardByKeySafe("id:" + id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Map.findUniqueAt(shard, "id:"+id, s.ts)
+}
+
+// same as Collection.ScanN, but the records are read as of the time the snapshot was taken
+func (s *Snapshot) ScanN(c *Collection, entry CustomStructure, limit int) ([][]byte, error) {
+	err := s.check(c)
+	if err != nil {
+		return nil, err
+	}
+	c.layout.enter()
+	defer c.layout.leave()
+	p, err := c.plan(entry)
+	if err != nil {
+		return nil, err
+	}
+	// a unique key might have belonged to another record back then, so every shard is checked
+	return c.execute(p, limit, s.ts)
+}
+
+func (s *Snapshot) ScanOne(c *Collection, entry CustomStructure) ([]byte, error) {
+	data, err := s.ScanN(c, entry, 1)
+	if err != nil {
+		return nil, err
+	}
+	return data[0], nil
+}
+
+func (s *Snapshot) Scan(c *Collection, entry CustomStructure) ([][]byte, error) {
+	return s.ScanN(c, entry, SCAN_LIMIT)
+}
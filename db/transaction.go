@@ -0,0 +1,395 @@
+package db
+
+import (
+	"errors"
+	"github.com/rs/xid"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrTransactionFinished = errors.New("transaction is already finished")
+
+// a change of a single record applied to a shard, kept by a transaction to be able to undo it
+type shardChange struct {
+	shard *ConcurrentMapShared
+	op    int
+	// previous location of the updated record or the deleted record itself
+	old     *ShardOffset
+	oldKeys []string
+	// location of the written record or the new version of the updated one
+	offset  *ShardOffset
+	keys    []string
+	removed []string
+	seq     uint64
+	version uint64
+	// indexes of the shard before the written record or the new version was added
+	indexes *indexState
+	// time of the change, the versions kept for the snapshots at that time are dropped by undo
+	at uint64
+}
+
+// reverts the change, the caller must hold the shard lock.
+// Changes of a shard have to be undone in the reverse order, since the appended records are cut off the data file
+func (ch *shardChange) undo() {
+	shard := ch.shard
+	switch ch.op {
+	case walOpWrite, walOpUpdate:
+		for _, key := range ch.keys {
+			if shard.Items[key] == ch.offset {
+				delete(shard.Items, key)
+			}
+		}
+		if ch.op == walOpUpdate {
+			shard.insert(ch.old, ch.oldKeys)
+			shard.deadBytes -= int64(ch.old.Length)
+			shard.unretire(ch.old, ch.oldKeys, ch.at)
+		}
+		shard.restoreIndexes(ch.indexes)
+		// nobody could append anything after the record while the lock is held
+		shard.file.Truncate(ch.offset.Start)
+	case walOpDelete:
+		shard.setDeleted(ch.old, false)
+		shard.unretire(ch.old, nil, ch.at)
+	}
+}
+
+type txOp struct {
+	collection *Collection
+	op         int
+	id         string
+	payload    CustomStructure
+
+	shard    *ConcurrentMapShared
+	reserved []string
+	change   *shardChange
+}
+
+// A set of writes, updates and deletes across the collections of the database that are applied all together
+// or not at all. Nothing is visible to the others until Commit, which takes the locks of all of the affected shards.
+// Every change is written into the write-ahead log of its collection marked with the id of the transaction
+// and is replayed only if the commit record of the transaction has reached the log of the database
+type Transaction struct {
+	db   *Database
+	id   string
+	ops  []*txOp
+	done bool
+	mx   sync.Mutex
+}
+
+func (db *Database) Begin() *Transaction {
+	return &Transaction{db, xid.New().String(), make([]*txOp, 0), false, sync.Mutex{}}
+}
+
+// opens the log of the transactions, returns the transactions committed since the last synchronization
+func (db *Database) loadTransactionLog(path string) (map[string]bool, error) {
+	db.txMx.Lock()
+	defer db.txMx.Unlock()
+	db.txLog.Close()
+	db.txLog, db.txPath = nil, path
+	err := os.MkdirAll(path, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	committed := make(map[string]bool)
+	db.txLog, err = OpenWriteAheadLog(path, db.durability, 0, func(e *walEntry) error {
+		if e.Op == walOpCommit {
+			committed[e.TxId] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("transaction log replay failed due " + err.Error())
+	}
+	return committed, nil
+}
+
+// starts the log of the transactions of a new database together with its first collection
+func (db *Database) startTransactionLog() error {
+	db.txMx.Lock()
+	defer db.txMx.Unlock()
+	if db.txLog != nil {
+		return nil
+	}
+	err := os.MkdirAll(db.txPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// the collections of a new database have nothing to replay, so the leftovers are discarded
+	db.txLog, err = OpenWriteAheadLog(db.txPath, db.durability, 0, nil)
+	return err
+}
+
+// buffers a new record, returns the id the record is going to have
+func (tx *Transaction) Write(c *Collection, payload CustomStructure) (string, error) {
+	id := xid.New().String()
+	return id, tx.add(&txOp{collection: c, op: walOpWrite, id: id, payload: payload})
+}
+
+// buffers an update of the record (see Collection.Update)
+func (tx *Transaction) Update(c *Collection, id string, payload CustomStructure) error {
+	return tx.add(&txOp{collection: c, op: walOpUpdate, id: id, payload: payload})
+}
+
+// buffers a deletion of the record (see Collection.DeleteById)
+func (tx *Transaction) Delete(c *Collection, id string) error {
+	return tx.add(&txOp{collection: c, op: walOpDelete, id: id})
+}
+
+func (tx *Transaction) add(op *txOp) error {
+	tx.mx.Lock()
+	defer tx.mx.Unlock()
+	if tx.done {
+		return ErrTransactionFinished
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// discards the buffered changes
+func (tx *Transaction) Rollback() {
+	tx.mx.Lock()
+	tx.done = true
+	tx.ops = nil
+	tx.mx.Unlock()
+}
+
+// applies the buffered changes atomically. If any of them fails, none is applied
+func (tx *Transaction) Commit() error {
+	tx.mx.Lock()
+	defer tx.mx.Unlock()
+	if tx.done {
+		return ErrTransactionFinished
+	}
+	tx.done = true
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	// the log of the transactions is not rotated while the commit is in progress (see Database.Sync)
+	tx.db.txMx.RLock()
+	defer tx.db.txMx.RUnlock()
+	txLog := tx.db.txLog
+	if txLog == nil {
+		return errors.New("database has no collections")
+	}
+	// the shards of the collections stay in place until the changes are applied (see Collection.Reshard)
+	for _, c := range tx.collections() {
+		c.layout.enter()
+		defer c.layout.leave()
+	}
+	err := tx.resolve()
+	if err != nil {
+		return err
+	}
+	err = tx.reserve()
+	if err != nil {
+		tx.release()
+		return err
+	}
+
+	// all of the changes get the same time, so a snapshot sees either all of them or none
+	st := tx.db.clock.write()
+	shards := tx.lock(st)
+	err = tx.apply(st)
+	if err == nil {
+		err = tx.commitLogs(txLog)
+	}
+	if err != nil {
+		for i := len(tx.ops) - 1; i >= 0; i-- {
+			if tx.ops[i].change != nil {
+				tx.ops[i].change.undo()
+			}
+		}
+	}
+	for _, shard := range shards {
+		shard.Unlock()
+	}
+	tx.db.clock.done()
+	if err != nil {
+		tx.release()
+		return err
+	}
+	tx.finish()
+	return nil
+}
+
+// returns the collections affected by the transaction ordered by their names,
+// so the transactions enter them in the same order (see layoutLock)
+func (tx *Transaction) collections() []*Collection {
+	seen := make(map[*Collection]bool)
+	collections := make([]*Collection, 0)
+	for _, op := range tx.ops {
+		if op.collection != nil && !seen[op.collection] {
+			seen[op.collection] = true
+			collections = append(collections, op.collection)
+		}
+	}
+	sort.Slice(collections, func(i, j int) bool { return collections[i].Name < collections[j].Name })
+	return collections
+}
+
+// finds the shards of the records
+func (tx *Transaction) resolve() error {
+	// records written by the transaction itself have no destinations yet
+	written := make(map[*Collection]map[string]*ConcurrentMapShared)
+	for _, op := range tx.ops {
+		if op.collection == nil {
+			return errors.New("transaction refers to a nil collection")
+		}
+		if op.op == walOpWrite {
+			op.shard = op.collection.Map.placeShard(op.id)
+			if written[op.collection] == nil {
+				written[op.collection] = make(map[string]*ConcurrentMapShared)
+			}
+			written[op.collection][op.id] = op.shard
+			continue
+		}
+		if shard, ok := written[op.collection][op.id]; ok {
+			op.shard = shard
+			continue
+		}
+		shard, err := op.collection.getShardByKeySafe("id:" + op.id)
+		if err != nil {
+			return errors.New("record " + op.id + " of the collection " + op.collection.Name + " was not found")
+		}
+		op.shard = shard
+	}
+	return nil
+}
+
+// reserves the unique keys of the written and updated records
+func (tx *Transaction) reserve() error {
+	for _, op := range tx.ops {
+		if op.op == walOpDelete {
+			continue
+		}
+		reserved, err := op.collection.Map.reserveUniques(op.id, op.payload.GetDataIndex())
+		if err != nil {
+			return err
+		}
+		op.reserved = reserved
+	}
+	return nil
+}
+
+func (tx *Transaction) release() {
+	for _, op := range tx.ops {
+		op.collection.Map.releaseUniques(op.id, op.reserved)
+	}
+}
+
+// locks every affected shard in the same order, so concurrent transactions can not deadlock
+func (tx *Transaction) lock(st stamp) []*ConcurrentMapShared {
+	type target struct {
+		collection string
+		shard      *ConcurrentMapShared
+	}
+	seen := make(map[*ConcurrentMapShared]bool)
+	targets := make([]target, 0, len(tx.ops))
+	for _, op := range tx.ops {
+		if !seen[op.shard] {
+			seen[op.shard] = true
+			targets = append(targets, target{op.collection.Name, op.shard})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].collection != targets[j].collection {
+			return targets[i].collection < targets[j].collection
+		}
+		return targets[i].shard.Id < targets[j].shard.Id
+	})
+	shards := make([]*ConcurrentMapShared, len(targets))
+	for i, t := range targets {
+		t.shard.Lock()
+		t.shard.forget(st)
+		shards[i] = t.shard
+	}
+	return shards
+}
+
+// applies the changes, the shard locks must be held
+func (tx *Transaction) apply(st stamp) error {
+	for _, op := range tx.ops {
+		m := op.collection.Map
+		var err error
+		switch op.op {
+		case walOpWrite:
+			var data []byte
+			data, err = m.format.encode(Element{op.id, op.payload, 1})
+			if err == nil {
+				op.change, err = m.writeLocked(op.shard, op.id, op.payload.GetDataIndex(), data, tx.id, st)
+			}
+		case walOpUpdate:
+			op.change, err = m.updateLocked(op.shard, op.id, ANY_VERSION, op.payload.GetDataIndex(), op.payload, tx.id, st)
+		case walOpDelete:
+			op.change, err = m.deleteLocked(op.shard, op.id, tx.id, st)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makes the changes durable and then writes the commit record
+func (tx *Transaction) commitLogs(txLog *WriteAheadLog) error {
+	seqs := make(map[*WriteAheadLog]uint64)
+	for _, op := range tx.ops {
+		wal := op.collection.Map.wal
+		if op.change.seq > seqs[wal] {
+			seqs[wal] = op.change.seq
+		}
+	}
+	for wal, seq := range seqs {
+		err := wal.Commit(seq)
+		if err != nil {
+			return err
+		}
+	}
+	seq, err := txLog.Append(&walEntry{Op: walOpCommit, TxId: tx.id})
+	if err != nil {
+		return err
+	}
+	return txLog.Commit(seq)
+}
+
+// updates the state of the collections that is kept outside of the shards
+func (tx *Transaction) finish() {
+	for i, op := range tx.ops {
+		c, ch := op.collection, op.change
+		switch op.op {
+		case walOpWrite:
+			c.setDestinations(ch.keys, op.shard)
+			atomic.AddInt64(&c.ObjectsCounter, 1)
+		case walOpUpdate:
+			c.Map.releaseUniques(op.id, tx.released(i))
+			c.moveDestinations(op.shard, ch.removed, destinations(op.shard, ch.keys))
+		case walOpDelete:
+			atomic.AddInt64(&c.ObjectsCounter, -1)
+		}
+	}
+}
+
+// returns the unique keys the update has freed, unless a later change of the same record has taken them back
+func (tx *Transaction) released(i int) []string {
+	op := tx.ops[i]
+	final := op.change.keys
+	for _, later := range tx.ops[i+1:] {
+		if later.collection == op.collection && later.id == op.id && later.op == walOpUpdate {
+			final = later.change.keys
+		}
+	}
+	taken := make(map[string]bool, len(final))
+	for _, key := range final {
+		taken[key] = true
+	}
+	released := make([]string, 0, len(op.change.removed))
+	for _, key := range op.change.removed {
+		if !taken[key] {
+			released = append(released, key)
+		}
+	}
+	return released
+}
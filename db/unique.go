@@ -0,0 +1,86 @@
+package db
+
+import "strings"
+
+// Returned when a value of a unique index is already taken by another record of the collection
+type ErrDuplicateKey struct {
+	Field string
+	Value string
+}
+
+func (e *ErrDuplicateKey) Error() string {
+	return "duplicate value \"" + e.Value + "\" of the unique key " + e.Field
+}
+
+// reports whether the key of a shard belongs to a unique index (neither an "id" key nor a slot of a regular index)
+func isUniqueKey(key string) bool {
+	if strings.HasPrefix(key, "id:") {
+		return false
+	}
+	_, _, ok := splitSlotKey(key)
+	return !ok
+}
+
+// reserves the unique keys of the record across the whole collection, either all of them or none.
+// Keys already held by the record are fine. Returns the newly reserved keys.
+// A key stays reserved until the record is dropped by a compaction, so a deleted record can always be restored
+func (m *ConcurrentMap) reserveUniques(id string, indexData []*FullDataIndex) ([]string, error) {
+	m.uniqueMx.Lock()
+	defer m.uniqueMx.Unlock()
+	reserved := make([]string, 0)
+	for _, ix := range indexData {
+		// an index without a value is not stored (see recordKeys), so it is not reserved either
+		if !ix.Unique || ix.Data == "" {
+			continue
+		}
+		fullKey := ix.Field + ":" + ix.Data
+		if owner, ok := m.uniques[fullKey]; ok {
+			if owner == id {
+				continue
+			}
+			for _, key := range reserved {
+				delete(m.uniques, key)
+			}
+			return nil, &ErrDuplicateKey{ix.Field, ix.Data}
+		}
+		m.uniques[fullKey] = id
+		reserved = append(reserved, fullKey)
+	}
+	return reserved, nil
+}
+
+// returns the id of the record that holds the unique key
+func (m *ConcurrentMap) uniqueOwner(fullKey string) (string, bool) {
+	m.uniqueMx.Lock()
+	defer m.uniqueMx.Unlock()
+	id, ok := m.uniques[fullKey]
+	return id, ok
+}
+
+// releases the unique keys if they are still reserved by the record
+func (m *ConcurrentMap) releaseUniques(id string, keys []string) {
+	m.uniqueMx.Lock()
+	defer m.uniqueMx.Unlock()
+	for _, key := range keys {
+		if owner, ok := m.uniques[key]; ok && owner == id {
+			delete(m.uniques, key)
+		}
+	}
+}
+
+// recalculates the reservations from the keys of the shards
+func (m *ConcurrentMap) rebuildUniques() {
+	uniques := make(map[string]string)
+	for _, shard := range m.Shared {
+		shard.RLock()
+		for key, item := range shard.Items {
+			if isUniqueKey(key) {
+				uniques[key] = item.id
+			}
+		}
+		shard.RUnlock()
+	}
+	m.uniqueMx.Lock()
+	m.uniques = uniques
+	m.uniqueMx.Unlock()
+}
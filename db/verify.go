@@ -0,0 +1,131 @@
+package db
+
+import (
+	"sort"
+)
+
+// Result of the verification of a single shard
+type ShardReport struct {
+	Shard int
+	// records with a broken header or checksum, including a torn tail of the data file
+	Corrupted []ShardOffset
+	// valid records that are not referenced by any key, the old versions of the updated records are not included
+	Orphaned []ShardOffset
+	// keys that refer to a location which is not a beginning of a record
+	Dangling []string
+}
+
+func (r *ShardReport) Ok() bool {
+	return len(r.Corrupted) == 0 && len(r.Orphaned) == 0 && len(r.Dangling) == 0
+}
+
+type VerifyReport struct {
+	Collection string
+	Shards     []*ShardReport
+}
+
+// returns true if none of the shards has problems
+func (r *VerifyReport) Ok() bool {
+	for _, s := range r.Shards {
+		if !s.Ok() {
+			return false
+		}
+	}
+	return true
+}
+
+// Walks through every record of the data file and checks it against the metadata of the shard
+func (shard *ConcurrentMapShared) Verify() (*ShardReport, error) {
+	shard.mx.RLock()
+	defer shard.mx.RUnlock()
+
+	report := &ShardReport{Shard: shard.Id}
+	fi, err := shard.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// start -> record
+	valid := make(map[int64]ShardOffset)
+	corrupted := make(map[int64]ShardOffset)
+	err = scanRecords(shard.file, fi.Size(), func(offset ShardOffset, payload []byte, err error) error {
+		if err != nil {
+			corrupted[offset.Start] = offset
+		} else {
+			valid[offset.Start] = offset
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[int64]bool)
+	for key, item := range shard.Items {
+		if record, ok := valid[item.Start]; ok && record.Length == item.Length {
+			referenced[item.Start] = true
+			continue
+		}
+		if record, ok := corrupted[item.Start]; ok && record.Length == item.Length {
+			continue
+		}
+		report.Dangling = append(report.Dangling, key)
+	}
+	for _, record := range corrupted {
+		report.Corrupted = append(report.Corrupted, record)
+	}
+	for start, record := range valid {
+		if !referenced[start] && !shard.superseded(&record) {
+			report.Orphaned = append(report.Orphaned, record)
+		}
+	}
+
+	sort.Strings(report.Dangling)
+	sortOffsets(report.Corrupted)
+	sortOffsets(report.Orphaned)
+	return report, nil
+}
+
+// reports whether the record is an old version of a record that is still present in the shard
+func (shard *ConcurrentMapShared) superseded(record *ShardOffset) bool {
+	e, err := shard.readElement(record)
+	if err != nil {
+		return false
+	}
+	_, ok := shard.Items["id:"+e.Id]
+	return ok
+}
+
+func sortOffsets(offsets []ShardOffset) {
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].Start < offsets[j].Start })
+}
+
+// verifies every shard of the collection
+func (c *Collection) Verify() (*VerifyReport, error) {
+	c.layout.enter()
+	defer c.layout.leave()
+	report := &VerifyReport{Collection: c.Name, Shards: make([]*ShardReport, 0, len(c.Map.Shared))}
+	for _, shard := range c.Map.Shared {
+		r, err := shard.Verify()
+		if err != nil {
+			return nil, err
+		}
+		report.Shards = append(report.Shards, r)
+	}
+	return report, nil
+}
+
+// verifies every collection of the database
+func (db *Database) Verify() ([]*VerifyReport, error) {
+	db.collectionMutex.RLock()
+	defer db.collectionMutex.RUnlock()
+	reports := make([]*VerifyReport, 0, len(db.collections))
+	for _, c := range db.collections {
+		r, err := c.Verify()
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
@@ -0,0 +1,33 @@
+package db
+
+import "strconv"
+
+// expected version that matches any version of the record
+const ANY_VERSION = ^uint64(0)
+
+// Returned by CompareAndSwap when the stored version of the record differs from the expected one
+type ErrVersionConflict struct {
+	Id       string
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *ErrVersionConflict) Error() string {
+	return "record " + e.Id + " has version " + strconv.FormatUint(e.Actual, 10) +
+		", expected " + strconv.FormatUint(e.Expected, 10)
+}
+
+// rewrites the record (see Update) only if nobody has changed it since the expected version was read.
+// Returns the new version of the record
+func (c *Collection) CompareAndSwap(id string, expectedVersion uint64, payload CustomStructure) (uint64, error) {
+	return c.update(id, expectedVersion, payload)
+}
+
+// returns the decoded record together with its version
+func (c *Collection) FindElementById(id string) (*Element, error) {
+	data, err := c.FindById(id, false)
+	if err != nil {
+		return nil, err
+	}
+	return c.DecodeElement(data)
+}
@@ -0,0 +1,356 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Durability modes of the write-ahead log
+const (
+	WAL_SYNC_ALWAYS = iota // fsync the log before every acknowledgement
+	WAL_SYNC_GROUP         // fsync the log periodically, writers wait for the next group commit
+	WAL_SYNC_NONE          // never fsync, leave it to the operating system
+)
+
+const (
+	walOpWrite = iota + 1
+	walOpDelete
+	walOpRestore
+	walOpUpdate
+	walOpCommit // commit record of a transaction, written into the log of the database
+)
+
+const walFrameHeaderSize = 8
+
+// how often the log is flushed in the WAL_SYNC_GROUP mode
+var WAL_GROUP_COMMIT_INTERVAL = 10 * time.Millisecond
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A single record of the log. Every mutation of a shard is described by one entry
+type walEntry struct {
+	Seq    uint64
+	Op     int
+	Shard  int
+	Offset ShardOffset
+	Data   []byte
+	Keys   []string
+	// keys the record is no longer stored under (walOpUpdate)
+	Removed []string
+	// the entry is applied on replay only if the commit record of its transaction is found (see Transaction)
+	TxId string
+}
+
+// Per-collection write-ahead log. Entries are appended into wal_<generation>.log files,
+// a new generation is started on every checkpoint (see Collection.Sync)
+type WriteAheadLog struct {
+	path string
+	mode int
+
+	file      *os.File
+	gen       uint64
+	seq       uint64
+	syncedSeq uint64
+
+	mx   sync.Mutex
+	cond *sync.Cond
+	// stops the group commit loop, nil unless the log is in the WAL_SYNC_GROUP mode
+	stop chan struct{}
+}
+
+func walFileName(path string, gen uint64) string {
+	return path + "/wal_" + strconv.FormatUint(gen, 10) + ".log"
+}
+
+// returns generations of all of the log files found in the directory in ascending order
+func walGenerations(path string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	gens := make([]uint64, 0)
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, "wal_") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		gen, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "wal_"), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		gens = append(gens, gen)
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i] < gens[j] })
+	return gens, nil
+}
+
+// Opens the log located in the path. Every entry that was left from the previous run
+// is passed to the replay function before a new generation of the log is started.
+// If the replay function is nil, the previous entries are discarded.
+// The entries are numbered above seq, which has to cover the changes already saved in the metadata
+func OpenWriteAheadLog(path string, mode int, seq uint64, replay func(e *walEntry) error) (*WriteAheadLog, error) {
+	w := &WriteAheadLog{path: path, mode: mode, seq: seq}
+	w.cond = sync.NewCond(&w.mx)
+
+	gens, err := walGenerations(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, gen := range gens {
+		if replay == nil {
+			err = os.Remove(walFileName(path, gen))
+		} else {
+			err = w.replayFile(walFileName(path, gen), replay)
+		}
+		if err != nil {
+			return nil, err
+		}
+		w.gen = gen
+	}
+
+	w.gen++
+	w.file, err = os.OpenFile(walFileName(path, w.gen), os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	w.syncedSeq = w.seq
+	w.mx.Lock()
+	w.runGroupCommit()
+	w.mx.Unlock()
+	return w, nil
+}
+
+func (w *WriteAheadLog) replayFile(name string, replay func(e *walEntry) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	header := make([]byte, walFrameHeaderSize)
+	for {
+		_, err = io.ReadFull(reader, header)
+		if err != nil {
+			// the tail of the log could be torn by a crash, such entries were never acknowledged
+			return nil
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(header[:4]))
+		_, err = io.ReadFull(reader, data)
+		if err != nil || crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+			return nil
+		}
+		e := new(walEntry)
+		err = GetGobDecoder(data).Decode(e)
+		if err != nil {
+			return errors.New("write-ahead log " + name + " is corrupted due " + err.Error())
+		}
+		if e.Seq > w.seq {
+			w.seq = e.Seq
+		}
+		if replay != nil {
+			err = replay(e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *WriteAheadLog) SetMode(mode int) {
+	if w == nil {
+		return
+	}
+	w.mx.Lock()
+	w.mode = mode
+	w.runGroupCommit()
+	w.mx.Unlock()
+}
+
+// starts the group commit loop in the WAL_SYNC_GROUP mode and stops it in the others,
+// the writers waiting for the stopped loop are released once the log is synced. w.mx must be held
+func (w *WriteAheadLog) runGroupCommit() {
+	if w.mode == WAL_SYNC_GROUP && w.stop == nil && w.file != nil {
+		w.stop = make(chan struct{})
+		go w.groupCommitLoop(w.stop)
+	} else if w.mode != WAL_SYNC_GROUP && w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+		if w.file != nil && w.file.Sync() == nil {
+			w.syncedSeq = w.seq
+		}
+		w.cond.Broadcast()
+	}
+}
+
+// Writes the entry to the log and returns its sequence number.
+// The entry is not guaranteed to be on the drive until Commit is called
+func (w *WriteAheadLog) Append(e *walEntry) (uint64, error) {
+	if w == nil {
+		return 0, nil
+	}
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.file == nil {
+		return 0, errors.New("write-ahead log is closed")
+	}
+
+	w.seq++
+	e.Seq = w.seq
+	data, err := EncodeGob(e)
+	if err != nil {
+		w.seq--
+		return 0, err
+	}
+	frame := make([]byte, walFrameHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(frame[:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(data, crcTable))
+	copy(frame[walFrameHeaderSize:], data)
+	_, err = w.file.Write(frame)
+	if err != nil {
+		w.seq--
+		return 0, err
+	}
+	return e.Seq, nil
+}
+
+// Blocks until the entry with the given sequence number is durable according to the mode of the log
+func (w *WriteAheadLog) Commit(seq uint64) error {
+	if w == nil || seq == 0 {
+		return nil
+	}
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	switch w.mode {
+	case WAL_SYNC_ALWAYS:
+		if w.syncedSeq >= seq {
+			return nil
+		}
+		if w.file == nil {
+			return errors.New("write-ahead log is closed")
+		}
+		err := w.file.Sync()
+		if err != nil {
+			return err
+		}
+		w.syncedSeq = w.seq
+	case WAL_SYNC_GROUP:
+		for w.syncedSeq < seq {
+			if w.file == nil {
+				return errors.New("write-ahead log is closed")
+			}
+			w.cond.Wait()
+		}
+	}
+	return nil
+}
+
+func (w *WriteAheadLog) groupCommitLoop(stop chan struct{}) {
+	ticker := time.NewTicker(WAL_GROUP_COMMIT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		w.mx.Lock()
+		if w.syncedSeq >= w.seq || w.file == nil {
+			w.mx.Unlock()
+			continue
+		}
+		target, f := w.seq, w.file
+		w.mx.Unlock()
+
+		err := f.Sync()
+
+		w.mx.Lock()
+		// the file could be rotated in the meantime, rotation syncs it by itself
+		if err == nil && target > w.syncedSeq {
+			w.syncedSeq = target
+		}
+		w.cond.Broadcast()
+		w.mx.Unlock()
+	}
+}
+
+// Starts a new generation of the log and returns the previous one.
+// Everything that belongs to the returned generation is flushed to the drive
+func (w *WriteAheadLog) Rotate() (uint64, error) {
+	if w == nil {
+		return 0, nil
+	}
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.file == nil {
+		return 0, errors.New("write-ahead log is closed")
+	}
+
+	err := w.file.Sync()
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(walFileName(w.path, w.gen+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+	w.file.Close()
+	w.file = f
+	w.gen++
+	w.syncedSeq = w.seq
+	w.cond.Broadcast()
+	return w.gen - 1, nil
+}
+
+// Removes log files up to the given generation (inclusive), should be called
+// only once all of their entries are persisted in the shards metadata
+func (w *WriteAheadLog) Remove(gen uint64) error {
+	if w == nil {
+		return nil
+	}
+	gens, err := walGenerations(w.path)
+	if err != nil {
+		return err
+	}
+	for _, g := range gens {
+		if g > gen {
+			break
+		}
+		err = os.Remove(walFileName(w.path, g))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *WriteAheadLog) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+	err := w.file.Sync()
+	w.file.Close()
+	w.file = nil
+	w.syncedSeq = w.seq
+	w.cond.Broadcast()
+	return err
+}
@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&QueryPerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ages 1..40, the ages divisible by 4 live in X
+	for i := 1; i <= 40; i++ {
+		country := "Y"
+		if i%4 == 0 {
+			country = "X"
+		}
+		err = c.Write(&QueryPerson{"p" + strconv.Itoa(i), i, country, "town"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.DeleteById(mustFindId(t, c, "p40"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := c.Aggregate("Age", "Country", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatal("expected 2 groups, got", len(results))
+	}
+	// X: 4, 8, .., 36
+	x, y := results[0], results[1]
+	if x.Group != "X" || x.Count != 9 || x.Sum != 180 || x.Min != 4 || x.Max != 36 || x.Avg != 20 {
+		t.Fatal("unexpected aggregates of X", *x)
+	}
+	if y.Group != "Y" || y.Count != 30 || y.Sum != 600 || y.Min != 1 || y.Max != 39 {
+		t.Fatal("unexpected aggregates of Y", *y)
+	}
+
+	results, err = c.Aggregate("", "Age", db.Field("Age").Lte(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatal("expected 3 groups, got", len(results))
+	}
+	for i, r := range results {
+		if r.Group != i+1 || r.Count != 1 {
+			t.Fatal("unexpected group", i, *r)
+		}
+	}
+
+	results, err = c.Aggregate("Age", "", db.Field("City").Eq("town"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Group != nil || results[0].Count != 39 || results[0].Sum != 780 {
+		t.Fatal("unexpected totals", results)
+	}
+}
+
+func mustFindId(t *testing.T, c *db.Collection, name string) string {
+	elements, err := c.Query().Where("Name").Eq(name).Find()
+	if err != nil || len(elements) != 1 {
+		t.Fatal("expected one record named", name, "got", len(elements), err)
+	}
+	return elements[0].Id
+}
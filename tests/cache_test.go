@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// scans with the cache enabled and checks the names of the records
+func checkCachedScan(t *testing.T, c *db.Collection, entry db.CustomStructure, names ...string) {
+	results, err := c.Scan(entry, true)
+	if len(names) == 0 {
+		if err == nil {
+			t.Fatal("expected no records, got", len(results))
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make([]string, 0, len(results))
+	for _, data := range results {
+		el, err := c.DecodeElement(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, el.Payload.(*PagedPerson).Name)
+	}
+	checkQueryNames(t, found, names...)
+}
+
+func TestCacheIsInvalidated(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&PagedPerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		err = c.Write(&PagedPerson{"p" + strconv.Itoa(i), i, "X"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := mustFindId(t, c, "p1")
+
+	// the cached records are returned as they are
+	for i := 0; i < 2; i++ {
+		data, err := c.FindById(id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		el, err := c.DecodeElement(data)
+		if err != nil || el.Payload.(*PagedPerson).Name != "p1" {
+			t.Fatal("unexpected cached record", el, err)
+		}
+		checkCachedScan(t, c, &PagedPerson{Country: "X"}, "p1", "p2", "p3", "p4")
+	}
+	// the limit is a part of the key
+	one, err := c.ScanN(&PagedPerson{Country: "X"}, 1, true)
+	if err != nil || len(one) != 1 {
+		t.Fatal("expected one record, got", len(one), err)
+	}
+
+	err = c.Write(&PagedPerson{"p5", 5, "X"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCachedScan(t, c, &PagedPerson{Country: "X"}, "p1", "p2", "p3", "p4", "p5")
+	checkCachedScan(t, c, &PagedPerson{Country: "Y"})
+
+	// the record leaves the results of its old values and joins the new ones
+	err = c.Update(id, &PagedPerson{"p1", 1, "Y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCachedScan(t, c, &PagedPerson{Country: "X"}, "p2", "p3", "p4", "p5")
+	checkCachedScan(t, c, &PagedPerson{Country: "Y"}, "p1")
+	data, err := c.FindById(id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil || el.Payload.(*PagedPerson).Country != "Y" {
+		t.Fatal("stale record is returned", el, err)
+	}
+
+	// the results are dropped by the other keys of the record as well
+	checkCachedScan(t, c, &PagedPerson{Age: 2}, "p2")
+	_, err = c.DeleteN(&PagedPerson{Name: "p2"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCachedScan(t, c, &PagedPerson{Country: "X"}, "p3", "p4", "p5")
+	checkCachedScan(t, c, &PagedPerson{Age: 2})
+	_, err = c.RestoreN(&PagedPerson{Name: "p2"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCachedScan(t, c, &PagedPerson{Age: 2}, "p2")
+	checkCachedScan(t, c, &PagedPerson{Country: "X"}, "p2", "p3", "p4", "p5")
+
+	err = c.DeleteById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCachedScan(t, c, &PagedPerson{Country: "Y"})
+	_, err = c.FindById(id, true)
+	if err == nil {
+		t.Fatal("deleted record is returned from the cache")
+	}
+
+	tx := database.Begin()
+	tx.Write(c, &PagedPerson{"p6", 6, "Y"})
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCachedScan(t, c, &PagedPerson{Country: "Y"}, "p6")
+
+	_, err = c.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCachedScan(t, c, &PagedPerson{Country: "X"}, "p2", "p3", "p4", "p5")
+}
+
+func TestCacheOptions(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&PagedPerson{})
+	opts := db.CollectionOptions{Cache: db.CacheOptions{SizeMB: 16, TTL: time.Hour, Uncompressed: true}}
+	c, err := database.AddCollection("people", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, err := database.AddCollection("uncached", db.CollectionOptions{Cache: db.CacheOptions{Disabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, coll := range []*db.Collection{c, off} {
+		err = coll.Write(&PagedPerson{"p1", 1, "X"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			checkCachedScan(t, coll, &PagedPerson{Country: "X"}, "p1")
+		}
+	}
+
+	stats := c.CacheStats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Bytes <= 0 {
+		t.Fatal("unexpected cache stats", stats)
+	}
+	err = c.Update(mustFindId(t, c, "p1"), &PagedPerson{"p1", 1, "Y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = c.CacheStats()
+	if stats.Invalidations != 1 || stats.Entries != 0 {
+		t.Fatal("unexpected cache stats after the update", stats)
+	}
+	if stats = off.CacheStats(); stats.Hits != 0 || stats.Entries != 0 {
+		t.Fatal("disabled cache is used", stats)
+	}
+
+	// the options are kept in the descriptor of the collection
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newTestDatabase()
+	reloaded.RegisterType(&PagedPerson{})
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Options.Cache != opts.Cache || reloaded.GetCollection("people").Options != c.Options || reloaded.GetCollection("uncached").Cache != nil {
+		t.Fatal("cache options were not restored", reloaded.GetCollection("people").Options)
+	}
+}
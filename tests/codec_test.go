@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"encoding/json"
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	defer enterTempDir(t)()
+
+	// a stand-in for the protobuf library
+	db.RegisterCodec(db.CODEC_PROTOBUF, db.NewProtobufCodec(json.Marshal, json.Unmarshal))
+	codecs := []string{db.CODEC_GOB, db.CODEC_JSON, db.CODEC_MSGPACK, db.CODEC_PROTOBUF}
+
+	database := newTestDatabase()
+	database.RegisterType(&PagedPerson{})
+	for i, codec := range codecs {
+		c, err := database.AddCollectionWithOptions(codec, db.CollectionOptions{Codec: codec, Compression: i / 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 1; j <= 5; j++ {
+			err = c.Write(&PagedPerson{"p" + strconv.Itoa(j), j, "X"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = c.Update(mustFindId(t, c, "p2"), &PagedPerson{"p2", 2, "Y"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the records of the JSON codec can be read without the Go types
+	data, err := database.GetCollection(db.CODEC_JSON).FindById(mustFindId(t, database.GetCollection(db.CODEC_JSON), "p2"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record struct {
+		Type    string                 `json:"t"`
+		Version uint64                 `json:"v"`
+		Payload map[string]interface{} `json:"p"`
+	}
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Type != "PagedPerson" || record.Version != 2 || record.Payload["Country"] != "Y" {
+		t.Fatal("unexpected JSON record", string(data))
+	}
+
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newTestDatabase()
+	reloaded.RegisterType(&PagedPerson{})
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range codecs {
+		c := reloaded.GetCollection(codec)
+		if c.Options.Codec != codec {
+			t.Fatal("codec was not restored", c.Options.Codec)
+		}
+		el, err := c.FindElementById(mustFindId(t, c, "p2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := el.Payload.(*PagedPerson); p.Country != "Y" || p.Age != 2 || el.Version != 2 {
+			t.Fatal("record of the codec", codec, "is damaged", p, el.Version)
+		}
+		checkCachedScan(t, c, &PagedPerson{Country: "X"}, "p1", "p3", "p4", "p5")
+	}
+}
+
+// the payloads are stored under the registered name, so their type can be renamed later
+func TestCodecRegisteredTypeName(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterTypeName("person", &NamedPerson{})
+	c, err := database.AddCollectionWithOptions("people", db.CollectionOptions{Codec: db.CODEC_JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Write(&NamedPerson{"p1", 1, "X"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.ScanOne(&NamedPerson{Name: "p1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record struct {
+		Type string `json:"t"`
+	}
+	err = json.Unmarshal(data, &record)
+	if err != nil || record.Type != "person" {
+		t.Fatal("record does not refer to the registered name", string(data))
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := el.Payload.(*NamedPerson); !ok || p.Country != "X" {
+		t.Fatal("record was not decoded", el.Payload)
+	}
+
+	// every payload type has to be registered
+	err = c.Write(&UnregisteredPerson{"p2"})
+	if err == nil {
+		t.Fatal("payload of an unregistered type was written")
+	}
+}
+
+type NamedPerson PagedPerson
+
+func (p *NamedPerson) GetDataIndex() []*db.FullDataIndex {
+	return (*PagedPerson)(p).GetDataIndex()
+}
+
+type UnregisteredPerson struct {
+	Name string
+}
+
+func (p *UnregisteredPerson) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{{Field: "Name", Data: p.Name, Unique: true}}
+}
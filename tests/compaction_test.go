@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func checkCompactedCollection(t *testing.T, c *db.Collection) {
+	if c.Size() != 90 {
+		t.Fatal("expected 90 objects, got", c.Size())
+	}
+	report, err := c.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok() {
+		t.Fatal("compacted collection is damaged")
+	}
+	results, err := c.Scan(&ExamplePerson{Age: 3}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 10 {
+		t.Fatal("expected 10 results, got", len(results))
+	}
+	_, err = c.Scan(&ExamplePerson{Age: 2}, false)
+	if err == nil {
+		t.Fatal("deleted records are still found")
+	}
+	data, err := c.ScanOne(&ExamplePerson{FirstName: "person55", Age: 6}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil || el.Payload.(*ExamplePerson).FirstName != "person55" {
+		t.Fatal("record was damaged by the compaction", err)
+	}
+}
+
+func TestOptimizeReclaimsDeletedRecords(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%10 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// person1, person11, ... have Age 2
+	for i := 1; i < 100; i += 10 {
+		_, err = c.Delete(&ExamplePerson{FirstName: "person" + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := c.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n <= 0 {
+		t.Fatal("nothing was reclaimed")
+	}
+	checkCompactedCollection(t, c)
+
+	// the compacted shards are switched on the drive as well
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCompactedCollection(t, reloaded.GetCollection("people"))
+}
+
+// a synchronization during the copy must not remove the new data file of the compaction
+func TestOptimizeDuringSync(t *testing.T) {
+	defer enterTempDir(t)()
+	defer func(size int) { db.COMPACTION_BUFFER_SIZE = size }(db.COMPACTION_BUFFER_SIZE)
+	// small writes make the copy slow
+	db.COMPACTION_BUFFER_SIZE = 16
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%10 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < 100; i += 10 {
+		_, err = c.Delete(&ExamplePerson{FirstName: "person" + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	synced := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				synced <- nil
+				return
+			default:
+			}
+			err := database.Sync()
+			if err != nil {
+				synced <- err
+				return
+			}
+		}
+	}()
+	_, err = c.Optimize()
+	close(stop)
+	if syncErr := <-synced; syncErr != nil {
+		t.Fatal(syncErr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCompactedCollection(t, c)
+
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCompactedCollection(t, reloaded.GetCollection("people"))
+}
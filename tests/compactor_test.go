@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBackgroundCompaction(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%10 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	database.StartCompaction(db.CompactorOptions{Ratio: 0.1, Interval: 10 * time.Millisecond})
+	defer database.StopCompaction()
+
+	for i := 1; i < 100; i += 10 {
+		_, err = c.Delete(&ExamplePerson{FirstName: "person" + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := database.CompactionStats()["people"]
+		if stats.LastError != "" {
+			t.Fatal(stats.LastError)
+		}
+		dead := int64(0)
+		for _, shard := range c.Map.Shared {
+			_, shardDead, err := shard.Space()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dead += shardDead
+		}
+		if stats.Compactions > 0 && dead == 0 {
+			if stats.ReclaimedBytes <= 0 {
+				t.Fatal("nothing was reclaimed")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shards were not compacted in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	database.StopCompaction()
+	if database.CompactionStats()["people"].Running {
+		t.Fatal("compactor is still running")
+	}
+	checkCompactedCollection(t, c)
+}
+
+// the background compaction runs while the database keeps being synchronized, the result can be reloaded
+func TestBackgroundCompactionDuringSync(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%10 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < 100; i += 10 {
+		_, err = c.Delete(&ExamplePerson{FirstName: "person" + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the throttled copy leaves the time for the synchronizations
+	database.StartCompaction(db.CompactorOptions{Ratio: 0.01, Interval: 10 * time.Millisecond, BytesPerSecond: 20000})
+	defer database.StopCompaction()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err = database.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := database.CompactionStats()["people"]
+		if stats.LastError != "" {
+			t.Fatal(stats.LastError)
+		}
+		dead := int64(0)
+		for _, shard := range c.Map.Shared {
+			_, shardDead, err := shard.Space()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dead += shardDead
+		}
+		if stats.Compactions > 0 && dead == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shards were not compacted in time")
+		}
+	}
+	database.StopCompaction()
+	checkCompactedCollection(t, c)
+
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCompactedCollection(t, reloaded.GetCollection("people"))
+}
@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+)
+
+type Account struct {
+	TenantId string
+	Email    string
+	Country  string
+	City     string
+}
+
+func (c *Account) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{
+		{"Email", c.Email, false},
+		{"Country", c.Country, false},
+		db.CompositeIndex(true, &db.FullDataIndex{"TenantId", c.TenantId, false}, &db.FullDataIndex{"Email", c.Email, false}),
+		db.CompositeIndex(false, &db.FullDataIndex{"Country", c.Country, false}, &db.FullDataIndex{"City", c.City, false}),
+	}
+}
+
+func scanAccounts(t *testing.T, c *db.Collection, probe *Account) []*Account {
+	results, err := c.Scan(probe, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts := make([]*Account, 0, len(results))
+	for _, data := range results {
+		el, err := c.DecodeElement(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts = append(accounts, el.Payload.(*Account))
+	}
+	return accounts
+}
+
+func TestCompositeIndex(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&Account{})
+	c, err := database.AddCollection("accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts := []*Account{
+		{"t1", "a@x", "PL", "Krakow"},
+		{"t2", "a@x", "PL", "Warsaw"},
+		{"t1", "b@x", "DE", "Berlin"},
+		{"t2", "b@x", "PL", "Krakow"},
+	}
+	for _, a := range accounts {
+		err = c.Write(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.Write(&Account{"t1", "a@x", "FR", "Paris"})
+	dup, ok := err.(*db.ErrDuplicateKey)
+	if !ok || dup.Field != "TenantId+Email" {
+		t.Fatal("duplicate pair was written", err)
+	}
+
+	found := scanAccounts(t, c, &Account{TenantId: "t2", Email: "a@x"})
+	if len(found) != 1 || found[0].City != "Warsaw" {
+		t.Fatal("composite unique index was not used", found)
+	}
+	found = scanAccounts(t, c, &Account{Country: "PL", City: "Krakow"})
+	if len(found) != 2 || found[0].City != "Krakow" || found[1].City != "Krakow" {
+		t.Fatal("composite index was not used", found)
+	}
+	// a composite index is not used until all of its fields are set
+	found = scanAccounts(t, c, &Account{Email: "b@x"})
+	if len(found) != 2 {
+		t.Fatal("expected 2 accounts, got", len(found))
+	}
+	found = scanAccounts(t, c, &Account{Country: "PL"})
+	if len(found) != 3 {
+		t.Fatal("expected 3 accounts, got", len(found))
+	}
+}
+
+// records without some of the fields of a unique composite index do not take its key
+func TestCompositeIndexIncomplete(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&Account{})
+	c, err := database.AddCollection("accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Write(&Account{"", "a@x", "PL", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Write(&Account{"", "a@x", "DE", ""})
+	if err != nil {
+		t.Fatal("second incomplete record was refused", err)
+	}
+	id, err := c.Upsert(&Account{"", "b@x", "PL", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(id, &Account{"", "b@x", "DE", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := scanAccounts(t, c, &Account{Email: "a@x"}); len(found) != 2 {
+		t.Fatal("expected 2 accounts, got", len(found))
+	}
+	n, err := c.Count(&Account{Country: "DE"})
+	if err != nil || n != 2 {
+		t.Fatal("expected 2 accounts in DE, got", n, err)
+	}
+
+	// once complete, the key is unique again
+	err = c.Write(&Account{"t1", "a@x", "PL", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Write(&Account{"t1", "a@x", "DE", ""})
+	if _, ok := err.(*db.ErrDuplicateKey); !ok {
+		t.Fatal("expected a duplicate key, got", err)
+	}
+}
@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCount(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&PagedPerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ages 1..30, the ages divisible by 3 live in X
+	for i := 1; i <= 30; i++ {
+		country := "Y"
+		if i%3 == 0 {
+			country = "X"
+		}
+		err = c.Write(&PagedPerson{"p" + strconv.Itoa(i), i, country})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := c.Delete(&PagedPerson{Name: "p3"})
+	if err != nil || n != 1 {
+		t.Fatal("expected one deleted record, got", n, err)
+	}
+	n, err = c.Delete(&PagedPerson{Name: "p1"})
+	if err != nil || n != 1 {
+		t.Fatal("expected one deleted record, got", n, err)
+	}
+
+	checkCount := func(expected, n int, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Fatal("expected", expected, "records, got", n)
+		}
+	}
+	n, err = c.Count(&PagedPerson{Country: "X"})
+	checkCount(9, n, err)
+	n, err = c.Count(&PagedPerson{Country: "Y", Age: 4})
+	checkCount(1, n, err)
+	n, err = c.Count(&PagedPerson{})
+	checkCount(28, n, err)
+	n, err = c.CountByIndex("Country", "Y")
+	checkCount(19, n, err)
+	n, err = c.CountByIndex("Age", 3)
+	checkCount(0, n, err)
+	n, err = c.CountByIndex("Age", 30)
+	checkCount(1, n, err)
+	n, err = c.CountByIndex("Name", "p1")
+	checkCount(0, n, err)
+	n, err = c.CountByIndex("Name", "p2")
+	checkCount(1, n, err)
+
+	_, err = c.Restore(&PagedPerson{Name: "p1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = c.CountByIndex("Country", "Y")
+	checkCount(20, n, err)
+}
@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"context"
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func TestIterate(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&QueryPerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		id, err := c.Upsert(&QueryPerson{"p" + strconv.Itoa(i), i, "X", "town"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[id] = true
+	}
+
+	// the changes made while iterating are not seen, every record is returned once
+	seen := make(map[string]bool)
+	err = c.Iterate(context.Background(), func(e *db.Element) error {
+		if seen[e.Id] {
+			t.Fatal("record", e.Id, "is returned twice")
+		}
+		seen[e.Id] = true
+		if len(seen) == 10 {
+			err := c.Write(&QueryPerson{"new", 100, "X", "town"})
+			if err != nil {
+				return err
+			}
+			for id := range ids {
+				err = c.Update(id, &QueryPerson{e.Payload.(*QueryPerson).Name + "_" + id, 0, "Y", "city"})
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(ids) {
+		t.Fatal("expected", len(ids), "records, got", len(seen))
+	}
+	for id := range ids {
+		if !seen[id] {
+			t.Fatal("record", id, "was not returned")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cur := c.Cursor(ctx)
+	defer cur.Close()
+	n := 0
+	for cur.Next() {
+		n++
+		if n == 5 {
+			cancel()
+		}
+	}
+	if n != 5 || cur.Err() != context.Canceled {
+		t.Fatal("expected the cursor to stop after 5 records, got", n, cur.Err())
+	}
+
+	// the cursors do not postpone the compaction once they are closed
+	_, err = c.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a cursor can be closed while another goroutine is reading it
+func TestCursorClosedConcurrently(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&QueryPerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		err = c.Write(&QueryPerson{"p" + strconv.Itoa(i), i, "X", "town"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cur := c.Cursor(context.Background())
+	done := make(chan int)
+	go func() {
+		n := 0
+		for cur.Next() {
+			n++
+		}
+		done <- n
+	}()
+	cur.Close()
+	if n := <-done; n > 200 || cur.Err() != nil {
+		t.Fatal("unexpected end of the cursor after", n, "records", cur.Err())
+	}
+	if cur.Next() {
+		t.Fatal("closed cursor moved to the next record")
+	}
+
+	// the compaction is not postponed by the closed cursor
+	_, err = c.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
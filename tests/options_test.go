@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"os"
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func TestCollectionOptions(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	opts := db.CollectionOptions{ShardCount: 8, Placement: db.PLACEMENT_HASH, Compression: db.COMPRESSION_GZIP}
+	c, err := database.AddCollectionWithOptions("people", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Map.Shared) != 8 || c.Options.Placement != db.PLACEMENT_HASH || c.Options.Codec != db.CODEC_GOB {
+		t.Fatal("options were not applied", len(c.Map.Shared), c.Options)
+	}
+	_, err = os.Stat(db.COLLECTION_DIR_NAME + "/people/" + db.ShardDataName(8))
+	if !os.IsNotExist(err) {
+		t.Fatal("extra shard file was created")
+	}
+
+	ids := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%5 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, mustFindExampleId(t, c, "person"+strconv.Itoa(i)))
+	}
+	err = c.Update(ids[2], &ExamplePerson{"person2", 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHashedCollection(t, c, ids)
+
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := reloaded.GetCollection("people")
+	if rc.Options != c.Options || len(rc.Map.Shared) != 8 || rc.Options.Placement != db.PLACEMENT_HASH {
+		t.Fatal("options were not restored", rc.Options, len(rc.Map.Shared))
+	}
+	checkHashedCollection(t, rc, ids)
+	data, err := rc.ScanOne(&ExamplePerson{Age: 40}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := rc.DecodeElement(data)
+	if err != nil || el.Id != ids[2] {
+		t.Fatal("updated record was not restored", err)
+	}
+
+	for _, invalid := range []db.CollectionOptions{{ShardCount: -1}, {Placement: 7}, {Codec: "xml"}, {Compression: 9}} {
+		_, err = database.AddCollectionWithOptions("invalid", invalid)
+		if err == nil {
+			t.Fatal("invalid options were accepted", invalid)
+		}
+	}
+}
+
+func mustFindExampleId(t *testing.T, c *db.Collection, name string) string {
+	data, err := c.ScanOne(&ExamplePerson{FirstName: name}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return el.Id
+}
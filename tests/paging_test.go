@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+type PagedPerson struct {
+	Name    string
+	Age     int
+	Country string
+}
+
+func (c *PagedPerson) GetDataIndex() []*db.FullDataIndex {
+	indexes := []*db.FullDataIndex{
+		{"Name", c.Name, true},
+		{"Country", c.Country, false},
+	}
+	// a probe without the age does not match it
+	if c.Age != 0 {
+		indexes = append(indexes, db.RangeIndex("Age", c.Age))
+	}
+	return indexes
+}
+
+// fetches every page of the scan and returns the records in the order they were returned
+func scanPages(t *testing.T, c *db.Collection, entry db.CustomStructure, opts db.ScanOptions) []*PagedPerson {
+	people := make([]*PagedPerson, 0)
+	for {
+		page, err := c.ScanPage(entry, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Results) > opts.Limit {
+			t.Fatal("page has", len(page.Results), "records, the limit is", opts.Limit)
+		}
+		for _, data := range page.Results {
+			el, err := c.DecodeElement(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			people = append(people, el.Payload.(*PagedPerson))
+		}
+		if page.Next == "" {
+			return people
+		}
+		opts.Cursor = page.Next
+	}
+}
+
+func TestScanPage(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&PagedPerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written out of order, aged 1..25, the even ages live in X
+	written := make([]string, 0)
+	for i := 0; i < 25; i++ {
+		age := (i*7)%25 + 1
+		country := "Y"
+		if age%2 == 0 {
+			country = "X"
+		}
+		name := "p" + strconv.Itoa(age)
+		err = c.Write(&PagedPerson{name, age, country})
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, name)
+	}
+
+	// by default the records are listed in the order they were written
+	people := scanPages(t, c, nil, db.ScanOptions{Limit: 7})
+	if len(people) != len(written) {
+		t.Fatal("expected", len(written), "records, got", len(people))
+	}
+	for i, p := range people {
+		if p.Name != written[i] {
+			t.Fatal("expected", written[i], "at", i, "got", p.Name)
+		}
+	}
+
+	people = scanPages(t, c, &PagedPerson{Country: "Y"}, db.ScanOptions{SortBy: "Age", Descending: true, Limit: 4})
+	if len(people) != 13 {
+		t.Fatal("expected 13 records, got", len(people))
+	}
+	for i, p := range people {
+		if p.Age != 25-i*2 {
+			t.Fatal("expected age", 25-i*2, "at", i, "got", p.Age)
+		}
+	}
+
+	// Name is not a range index
+	_, err = c.ScanPage(&PagedPerson{Country: "X"}, db.ScanOptions{SortBy: "Name", Limit: 5})
+	if err != db.ErrSortNotIndexed {
+		t.Fatal("expected the sort field to be refused, got", err)
+	}
+
+	// the records of the same value are split between the pages
+	for i := 0; i < 10; i++ {
+		err = c.Write(&PagedPerson{"q" + strconv.Itoa(i), i%5 + 1, "Z"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	people = scanPages(t, c, nil, db.ScanOptions{SortBy: "Age", Limit: 3})
+	if len(people) != 35 {
+		t.Fatal("expected 35 records, got", len(people))
+	}
+	seen := make(map[string]bool)
+	for i, p := range people {
+		if seen[p.Name] || i > 0 && p.Age < people[i-1].Age {
+			t.Fatal("records are not ordered by age", p.Name, "at", i)
+		}
+		seen[p.Name] = true
+	}
+
+	_, err = c.ScanPage(nil, db.ScanOptions{Cursor: "not a cursor"})
+	if err != db.ErrInvalidCursor {
+		t.Fatal("expected an invalid cursor error, got", err)
+	}
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func checkHashedCollection(t *testing.T, c *db.Collection, ids []string) {
+	if len(c.ShardDestinations) != 0 {
+		t.Fatal("hashed collection tracks", len(c.ShardDestinations), "destinations")
+	}
+	for i, id := range ids {
+		if id == "" {
+			// deleted
+			continue
+		}
+		data, err := c.FindById(id, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		el, err := c.DecodeElement(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if el.Id != id || el.Payload.(*ExamplePerson).FirstName != "person"+strconv.Itoa(i) {
+			t.Fatal("wrong record was found by id", id)
+		}
+	}
+	data, err := c.ScanOne(&ExamplePerson{FirstName: "person7"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil || el.Id != ids[7] {
+		t.Fatal("wrong record was found by the unique key", err)
+	}
+}
+
+func TestHashPlacement(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people", db.CollectionOptions{Placement: db.PLACEMENT_HASH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, 50)
+	for i := 0; i < 50; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%5 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := c.ScanOne(&ExamplePerson{FirstName: "person" + strconv.Itoa(i)}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		el, err := c.DecodeElement(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, el.Id)
+	}
+	checkHashedCollection(t, c, ids)
+
+	err = c.DeleteById(ids[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Delete(&ExamplePerson{FirstName: "person4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != 48 {
+		t.Fatal("expected 48 objects, got", c.Size())
+	}
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := reloaded.GetCollection("people")
+	if rc.Options.Placement != db.PLACEMENT_HASH {
+		t.Fatal("placement mode was not restored")
+	}
+	_, err = rc.FindById(ids[3], false)
+	if err == nil {
+		t.Fatal("deleted record is still found")
+	}
+	ids[3], ids[4] = "", ""
+	checkHashedCollection(t, rc, ids)
+}
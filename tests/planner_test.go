@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlannerIntersectsIndexes(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%4 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := c.Scan(&ExamplePerson{"person5", 2}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatal("expected 1 record, got", len(results))
+	}
+	_, err = c.Scan(&ExamplePerson{"person5", 3}, false)
+	if err == nil {
+		t.Fatal("record with another age was found")
+	}
+	results, err = c.Scan(&ExamplePerson{Age: 3}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 10 {
+		t.Fatal("expected 10 records, got", len(results))
+	}
+
+	plan, err := c.Explain(&ExamplePerson{"person5", 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Driver.Field != "FirstName" || plan.Driver.Estimate != 1 || len(plan.Filters) != 1 || plan.Filters[0].Field != "Age" {
+		t.Fatal("unexpected plan", plan)
+	}
+	if !strings.HasPrefix(plan.String(), "scan unique index FirstName") {
+		t.Fatal("unexpected explanation", plan.String())
+	}
+	plan, err = c.Explain(&ExamplePerson{Age: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Driver.Field != "Age" || plan.Driver.Estimate < 10 || len(plan.Filters) != 0 {
+		t.Fatal("unexpected plan", plan)
+	}
+
+	// the unset Age is indexed as "0" like in the zero struct, so it is not a condition
+	plan, err = c.Explain(&ExamplePerson{FirstName: "person5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Driver.Field != "FirstName" || len(plan.Filters) != 0 {
+		t.Fatal("unexpected plan", plan)
+	}
+	results, err = c.Scan(&ExamplePerson{FirstName: "person5"}, false)
+	if err != nil || len(results) != 1 {
+		t.Fatal("expected 1 record, got", len(results), err)
+	}
+}
+
+func TestPlannerFirstIndex(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollectionWithOptions("people", db.CollectionOptions{FirstIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%4 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// with FirstIndex the probe is looked up by its first index that has a value
+	results, err := c.Scan(&ExamplePerson{"person5", 3}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatal("expected 1 record, got", len(results))
+	}
+	plan, err := c.Explain(&ExamplePerson{"person5", 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Driver.Field != "FirstName" || len(plan.Filters) != 0 {
+		t.Fatal("unexpected plan", plan)
+	}
+}
+
+// the zero values of the range indexes are not conditions of a probe
+func TestPlannerSkipsZeroRangeValues(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&RangePerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		err = c.Write(&RangePerson{"person" + strconv.Itoa(i), i, float64(i) * 1.5, rangeEpoch.Add(time.Duration(i) * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan, err := c.Explain(&RangePerson{Name: "person7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Driver.Field != "Name" || len(plan.Filters) != 0 {
+		t.Fatal("unexpected plan", plan)
+	}
+	results, err := c.Scan(&RangePerson{Name: "person7", Age: 7}, false)
+	checkAges(t, decodeRangePeople(t, c, results, err), 7)
+	_, err = c.Explain(&RangePerson{})
+	if err == nil {
+		t.Fatal("empty probe has a plan")
+	}
+}
@@ -0,0 +1,262 @@
+package tests
+
+import (
+	"shardb/db"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type QueryPerson struct {
+	Name    string
+	Age     int
+	Country string
+	City    string
+}
+
+func (c *QueryPerson) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{
+		{"Name", c.Name, true},
+		db.RangeIndex("Age", c.Age),
+		{"Country", c.Country, false},
+	}
+}
+
+func queryNames(t *testing.T, elements []*db.Element, err error) []string {
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(elements))
+	for _, el := range elements {
+		names = append(names, el.Payload.(*QueryPerson).Name)
+	}
+	return names
+}
+
+func checkQueryNames(t *testing.T, names []string, expected ...string) {
+	sort.Strings(names)
+	sort.Strings(expected)
+	if len(names) != len(expected) {
+		t.Fatal("expected", expected, "got", names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatal("expected", expected, "got", names)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&QueryPerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// p0..p29, aged 0..29, every third lives in X, every fifth in the capital
+	for i := 0; i < 30; i++ {
+		country, city := "Y", "town"
+		if i%3 == 0 {
+			country = "X"
+		}
+		if i%5 == 0 {
+			city = "capital"
+		}
+		err = c.Write(&QueryPerson{"p" + strconv.Itoa(i), i, country, city})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := c.Query().Where("Age").Gt(25).Or(db.Field("Country").Eq("X")).Find()
+	checkQueryNames(t, queryNames(t, found, err), "p0", "p3", "p6", "p9", "p12", "p15", "p18", "p21", "p24", "p26", "p27", "p28", "p29")
+
+	// City is not indexed, the records are read and checked one by one
+	found, err = c.Query().Where("City").Eq("capital").Where("Age").Between(5, 20).Find()
+	checkQueryNames(t, queryNames(t, found, err), "p5", "p10", "p15", "p20")
+	found, err = c.Query().Where("Country").Eq("X").And(db.Not(db.Field("City").Eq("town"))).Find()
+	checkQueryNames(t, queryNames(t, found, err), "p0", "p15")
+	found, err = c.Query().Where("Age").Lt(10).Not().Where("Age").Lte(12).Find()
+	checkQueryNames(t, queryNames(t, found, err), "p10", "p11", "p12")
+	found, err = c.Query().Where("Name").In("p1", "p7", "missing").Find()
+	checkQueryNames(t, queryNames(t, found, err), "p1", "p7")
+	found, err = c.Query().Where("Country").Ne("Y").Where("Age").Gte(27).Find()
+	checkQueryNames(t, queryNames(t, found, err), "p27")
+
+	all, err := c.Query().Find()
+	if err != nil || len(all) != 30 {
+		t.Fatal("expected all of the records, got", len(all), err)
+	}
+	page, err := c.Query().Offset(10).Limit(5).Find()
+	if err != nil || len(page) != 5 {
+		t.Fatal("expected a page of 5 records, got", len(page), err)
+	}
+	for i := range page {
+		if page[i].Id != all[10+i].Id {
+			t.Fatal("page does not follow the order of the records")
+		}
+	}
+
+	s := database.Snapshot()
+	defer s.Close()
+	err = c.DeleteById(all[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err = c.Query().Where("Age").Gte(0).Find()
+	if err != nil || len(found) != 29 {
+		t.Fatal("expected 29 records after the delete, got", len(found), err)
+	}
+	found, err = s.Query(c).Where("Age").Gte(0).Find()
+	if err != nil || len(found) != 30 {
+		t.Fatal("expected 30 records in the snapshot, got", len(found), err)
+	}
+}
+
+// gob codec that counts the decoded records
+type countingCodec struct {
+	decoded *int64
+}
+
+func (c countingCodec) Encode(e *db.Element) ([]byte, error) {
+	return db.EncodeGob(e)
+}
+
+func (c countingCodec) Decode(data []byte) (*db.Element, error) {
+	atomic.AddInt64(c.decoded, 1)
+	e := new(db.Element)
+	return e, db.GetGobDecoder(data).Decode(e)
+}
+
+// a value that no record has is answered by the index without reading the records
+func TestQueryMissingIndexValue(t *testing.T) {
+	defer enterTempDir(t)()
+
+	decoded := int64(0)
+	db.RegisterCodec("counting", countingCodec{&decoded})
+	database := newTestDatabase()
+	database.RegisterType(&QueryPerson{})
+	c, err := database.AddCollectionWithOptions("people", db.CollectionOptions{Codec: "counting"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		err = c.Write(&QueryPerson{"p" + strconv.Itoa(i), i, "X", "town"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, q := range []*db.Query{c.Query().Where("Country").Eq("nowhere"), c.Query().Where("Name").Eq("missing"), c.Query().Where("Age").Eq(100)} {
+		found, err := q.Find()
+		checkQueryNames(t, queryNames(t, found, err))
+	}
+	if decoded != 0 {
+		t.Fatal("records were read for the missing values", decoded)
+	}
+	found, err := c.Query().Where("Country").Eq("X").Where("Age").Eq(3).Find()
+	checkQueryNames(t, queryNames(t, found, err), "p3")
+}
+
+// integers and floats are compared as numbers with a range index of either type
+func TestQueryMixedNumbers(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&RangePerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		err = c.Write(&RangePerson{"person" + strconv.Itoa(i), i, float64(i) * 1.5, rangeEpoch.Add(time.Duration(i) * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ages := func(elements []*db.Element, err error) []int {
+		if err != nil {
+			t.Fatal(err)
+		}
+		people := make([]*RangePerson, 0, len(elements))
+		for _, el := range elements {
+			people = append(people, el.Payload.(*RangePerson))
+		}
+		sort.Slice(people, func(i, j int) bool { return people[i].Age < people[j].Age })
+		checked := make([]int, 0, len(people))
+		for _, p := range people {
+			checked = append(checked, p.Age)
+		}
+		return checked
+	}
+	checkAgeList := func(found []int, expected ...int) {
+		if len(found) != len(expected) {
+			t.Fatal("expected ages", expected, "got", found)
+		}
+		for i := range found {
+			if found[i] != expected[i] {
+				t.Fatal("expected ages", expected, "got", found)
+			}
+		}
+	}
+
+	// Score is a float64 index
+	checkAgeList(ages(c.Query().Where("Score").Gt(12).Find()), 9, 10)
+	checkAgeList(ages(c.Query().Where("Score").Eq(3).Find()), 2)
+	// Age is an integer index
+	checkAgeList(ages(c.Query().Where("Age").Gt(7.5).Find()), 8, 9, 10)
+	checkAgeList(ages(c.Query().Where("Age").Lte(2.5).Find()), 1, 2)
+	checkAgeList(ages(c.Query().Where("Age").Eq(4.5).Find()))
+}
+
+type OptionalAgePerson struct {
+	Name string
+	Age  int
+}
+
+// an unknown age is not indexed
+func (c *OptionalAgePerson) GetDataIndex() []*db.FullDataIndex {
+	age := ""
+	if c.Age != 0 {
+		age = strconv.Itoa(c.Age)
+	}
+	return []*db.FullDataIndex{
+		{"Name", c.Name, true},
+		{"Age", age, false},
+	}
+}
+
+// a zero value is compared with the field of the struct when the index is left unset
+func TestQueryZeroValue(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&OptionalAgePerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = c.Write(&OptionalAgePerson{"p" + strconv.Itoa(i), i % 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := func(elements []*db.Element, err error) []string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make([]string, 0, len(elements))
+		for _, el := range elements {
+			found = append(found, el.Payload.(*OptionalAgePerson).Name)
+		}
+		return found
+	}
+	checkQueryNames(t, names(c.Query().Where("Age").Eq(0).Find()), "p0", "p3", "p6", "p9")
+	checkQueryNames(t, names(c.Query().Where("Age").Eq(2).Find()), "p2", "p5", "p8")
+	checkQueryNames(t, names(c.Query().Where("Age").Lt(1).Find()), "p0", "p3", "p6", "p9")
+}
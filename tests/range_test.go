@@ -0,0 +1,203 @@
+package tests
+
+import (
+	"math"
+	"shardb/db"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var rangeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type RangePerson struct {
+	Name  string
+	Age   int
+	Score float64
+	Born  time.Time
+}
+
+func (c *RangePerson) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{
+		{"Name", c.Name, true},
+		db.RangeIndex("Age", c.Age),
+		db.RangeIndex("Score", c.Score),
+		db.RangeIndex("Born", c.Born),
+	}
+}
+
+func decodeRangePeople(t *testing.T, c *db.Collection, results [][]byte, err error) []*RangePerson {
+	if err != nil {
+		t.Fatal(err)
+	}
+	people := make([]*RangePerson, 0, len(results))
+	for _, data := range results {
+		el, err := c.DecodeElement(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, el.Payload.(*RangePerson))
+	}
+	return people
+}
+
+func checkAges(t *testing.T, people []*RangePerson, ages ...int) {
+	if len(people) != len(ages) {
+		t.Fatal("expected", len(ages), "records, got", len(people))
+	}
+	for i, p := range people {
+		if p.Age != ages[i] {
+			t.Fatal("expected age", ages[i], "at", i, "got", p.Age)
+		}
+	}
+}
+
+func TestRangeIndex(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&RangePerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written out of order, ages from -5 to 24
+	ids := make(map[int]string)
+	for i := 0; i < 30; i++ {
+		age := (i*7)%30 - 5
+		err = c.Write(&RangePerson{"person" + strconv.Itoa(age), age, float64(age) * 1.5, rangeEpoch.Add(time.Duration(age) * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := c.ScanOne(&RangePerson{Name: "person" + strconv.Itoa(age)}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		el, _ := c.DecodeElement(data)
+		ids[age] = el.Id
+	}
+
+	results, err := c.ScanRange("Age", 20, 24, 100)
+	checkAges(t, decodeRangePeople(t, c, results, err), 20, 21, 22, 23, 24)
+	results, err = c.ScanRange("Age", -3, 1, 100)
+	checkAges(t, decodeRangePeople(t, c, results, err), -3, -2, -1, 0, 1)
+	results, err = c.ScanRange("Age", nil, nil, 3)
+	checkAges(t, decodeRangePeople(t, c, results, err), -5, -4, -3)
+	results, err = c.ScanRange("Score", -1.5, 3.0, 100)
+	checkAges(t, decodeRangePeople(t, c, results, err), -1, 0, 1, 2)
+	results, err = c.ScanRange("Born", rangeEpoch.Add(22*time.Hour), nil, 100)
+	checkAges(t, decodeRangePeople(t, c, results, err), 22, 23, 24)
+	// exact matches go through the same index
+	results, err = c.Scan(&RangePerson{Age: 7}, false)
+	checkAges(t, decodeRangePeople(t, c, results, err), 7)
+
+	s := database.Snapshot()
+	err = c.Update(ids[21], &RangePerson{"person21", 100, 0, rangeEpoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.DeleteById(ids[22])
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = c.ScanRange("Age", 20, nil, 100)
+	checkAges(t, decodeRangePeople(t, c, results, err), 20, 23, 24, 100)
+	results, err = s.ScanRange(c, "Age", 20, nil, 100)
+	checkAges(t, decodeRangePeople(t, c, results, err), 20, 21, 22, 23, 24)
+	s.Close()
+
+	// the values are restored on load and cleaned up by the compaction
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newTestDatabase()
+	reloaded.RegisterType(&RangePerson{})
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = reloaded.GetCollection("people")
+	_, err = reloaded.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = c.ScanRange("Age", 19, 200, 100)
+	checkAges(t, decodeRangePeople(t, c, results, err), 19, 20, 23, 24, 100)
+	_, err = c.ScanRange("Age", "a", nil, 100)
+	if err != nil {
+		t.Fatal("values of another type must be just skipped", err)
+	}
+}
+
+type CounterRecord struct {
+	Name  string
+	Count uint64
+}
+
+func (c *CounterRecord) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{
+		{"Name", c.Name, true},
+		db.RangeIndex("Count", c.Count),
+	}
+}
+
+// the unsigned values above math.MaxInt64 are ordered after the smaller ones
+func TestRangeIndexUnsigned(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&CounterRecord{})
+	c, err := database.AddCollection("counters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := []uint64{math.MaxUint64, 1, 1 << 63, 1 << 62, 1<<63 + 5}
+	for i, count := range counts {
+		err = c.Write(&CounterRecord{"c" + strconv.Itoa(i), count})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkCounts := func(results [][]byte, err error, expected ...uint64) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(expected) {
+			t.Fatal("expected", len(expected), "records, got", len(results))
+		}
+		for i, data := range results {
+			el, err := c.DecodeElement(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count := el.Payload.(*CounterRecord).Count; count != expected[i] {
+				t.Fatal("expected", expected[i], "at", i, "got", count)
+			}
+		}
+	}
+
+	results, err := c.ScanRange("Count", uint64(1<<62), nil, 100)
+	checkCounts(results, err, 1<<62, 1<<63, 1<<63+5, math.MaxUint64)
+	// the bounds of the other types are converted
+	results, err = c.ScanRange("Count", -10, 1.5, 100)
+	checkCounts(results, err, 1)
+	n, err := c.CountByIndex("Count", 1)
+	if err != nil || n != 1 {
+		t.Fatal("expected 1 record, got", n, err)
+	}
+	found, err := c.Query().Where("Count").Gt(uint64(1 << 63)).Find()
+	if err != nil || len(found) != 2 {
+		t.Fatal("expected 2 records, got", len(found), err)
+	}
+}
+
+// the type of an indexed field is fixed, so an unsupported one is a programming error
+func TestRangeIndexUnsupportedType(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("range index of an unsupported type was created")
+		}
+	}()
+	db.RangeIndex("Flag", true)
+}
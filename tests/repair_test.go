@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestRepairRebuildsLostShardMetadata(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i % 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lost, _ := filepath.Glob("collections/people/shard_1_meta.gob.gzip*")
+	lost2, _ := filepath.Glob("collections/people/people.json.gzip*")
+	for _, name := range append(lost, lost2...) {
+		os.Remove(name)
+	}
+
+	err = newTestDatabase().ScanAndLoadData("")
+	if err == nil {
+		t.Fatal("collection with the lost metadata was loaded")
+	}
+
+	repaired := newTestDatabase()
+	err = repaired.Repair("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := repaired.GetCollection("people")
+	if rc.Size() != 100 {
+		t.Fatal("expected 100 objects after the repair, got", rc.Size())
+	}
+	// person0 was written into the shard #1 whose metadata was lost
+	data, err := rc.ScanOne(&ExamplePerson{FirstName: "person0"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := rc.DecodeElement(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if el.Payload.(*ExamplePerson).FirstName != "person0" {
+		t.Fatal("wrong record was found")
+	}
+	results, err := rc.Scan(&ExamplePerson{Age: 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 10 {
+		t.Fatal("expected 10 results of the regular index, got", len(results))
+	}
+
+	// the repaired metadata is saved, so the regular load works again
+	err = newTestDatabase().ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,327 @@
+package tests
+
+import (
+	"io/ioutil"
+	"shardb/db"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// checks that every record of people is found by its unique name with its country
+func checkReshardedPeople(t *testing.T, c *db.Collection, people map[string]string) {
+	for name, country := range people {
+		data, err := c.ScanOne(&PagedPerson{Name: name}, false)
+		if err != nil {
+			t.Fatal("record", name, "was not found", err)
+		}
+		el, err := c.DecodeElement(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if el.Payload.(*PagedPerson).Country != country {
+			t.Fatal("record", name, "is damaged", el.Payload)
+		}
+	}
+	n, err := c.Count(&PagedPerson{})
+	if err != nil || n != len(people) {
+		t.Fatal("expected", len(people), "records, got", n, err)
+	}
+}
+
+func TestReshard(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&PagedPerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	people := make(map[string]string)
+	for i := 1; i <= 60; i++ {
+		name, country := "p"+strconv.Itoa(i), []string{"X", "Y", "Z"}[i%3]
+		err = c.Write(&PagedPerson{name, i, country})
+		if err != nil {
+			t.Fatal(err)
+		}
+		people[name] = country
+	}
+	_, err = c.Delete(&PagedPerson{Name: "p5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(people, "p5")
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the collection is written and updated while its records are moved
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 61; i <= 100; i++ {
+			err := c.Write(&PagedPerson{"p" + strconv.Itoa(i), i, "W"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		for i := 1; i <= 10; i += 3 {
+			err := c.Update(mustFindId(t, c, "p"+strconv.Itoa(i)), &PagedPerson{"p" + strconv.Itoa(i), i, "V"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	r, err := c.Reshard(8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if stats := r.Stats(); stats.Running || stats.Copied != stats.Total || stats.Total < 60 {
+		t.Fatal("unexpected progress", stats)
+	}
+	for i := 61; i <= 100; i++ {
+		people["p"+strconv.Itoa(i)] = "W"
+	}
+	for i := 1; i <= 10; i += 3 {
+		people["p"+strconv.Itoa(i)] = "V"
+	}
+
+	if len(c.Map.Shared) != 8 || c.Options.ShardCount != 8 {
+		t.Fatal("collection was not resharded", len(c.Map.Shared))
+	}
+	checkReshardedPeople(t, c, people)
+	n, err := c.CountByIndex("Country", "W")
+	if err != nil || n != 40 {
+		t.Fatal("expected 40 records of W, got", n, err)
+	}
+	data, err := c.ScanRange("Age", 20, 29, 100)
+	if err != nil || len(data) != 10 {
+		t.Fatal("expected 10 records in the range, got", len(data), err)
+	}
+	// the deleted record is moved as well
+	_, err = c.Restore(&PagedPerson{Name: "p5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	people["p5"] = "Z"
+	files, err := ioutil.ReadDir(db.COLLECTION_DIR_NAME + "/people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Name() == db.ShardDataName(8) || f.Name() == db.ShardMetaName(31) {
+			t.Fatal("old shard file was not removed", f.Name())
+		}
+	}
+
+	// the changes made after the resharding are replayed against the new layout
+	err = c.Write(&PagedPerson{"p101", 101, "W"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	people["p101"] = "W"
+	reloaded := newTestDatabase()
+	reloaded.RegisterType(&PagedPerson{})
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := reloaded.GetCollection("people")
+	if len(rc.Map.Shared) != 8 {
+		t.Fatal("expected 8 shards after the reload, got", len(rc.Map.Shared))
+	}
+	checkReshardedPeople(t, rc, people)
+}
+
+func waitReshardRetry(t *testing.T, r *db.Resharding) {
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Stats().Retries == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("resharding was not postponed", r.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReshardHashPlacement(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollectionWithOptions("people", db.CollectionOptions{ShardCount: 4, Placement: db.PLACEMENT_HASH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%5 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, mustFindExampleId(t, c, "person"+strconv.Itoa(i)))
+	}
+
+	// the resharding waits for the snapshot to be closed
+	s := database.Snapshot()
+	stopped, err := c.Reshard(16, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitReshardRetry(t, stopped)
+	if err = stopped.Stop(); err != db.ErrReshardStopped {
+		t.Fatal("resharding was not stopped", err)
+	}
+	r, err := c.Reshard(16, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitReshardRetry(t, r)
+	if len(c.Map.Shared) != 4 {
+		t.Fatal("collection was resharded while the snapshot was open")
+	}
+	s.Close()
+	err = r.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Map.Shared) != 16 {
+		t.Fatal("expected 16 shards, got", len(c.Map.Shared))
+	}
+	// every record is found in the shard derived from its id
+	checkHashedCollection(t, c, ids)
+
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHashedCollection(t, reloaded.GetCollection("people"), ids)
+}
+
+// the operations that keep coming do not hold the switch of the shards off
+func TestReshardUnderLoad(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%5 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := int32(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				_, err := c.Count(&ExamplePerson{Age: 3})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	r, err := c.Reshard(4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- r.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		err = r.Stop()
+		if err == db.ErrReshardStopped {
+			t.Error("resharding was starved by the readers")
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := c.Count(&ExamplePerson{Age: 3})
+	if err != nil || n != 40 || len(c.Map.Shared) != 4 {
+		t.Fatal("expected 40 records in 4 shards, got", n, len(c.Map.Shared), err)
+	}
+}
+
+// a synchronization during the copy must not remove the data files of the new layout
+func TestReshardDuringSync(t *testing.T) {
+	defer enterTempDir(t)()
+	defer func(size int) { db.COMPACTION_BUFFER_SIZE = size }(db.COMPACTION_BUFFER_SIZE)
+	// small writes make the copy slow
+	db.COMPACTION_BUFFER_SIZE = 16
+
+	database := newTestDatabase()
+	database.RegisterType(&PagedPerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	people := make(map[string]string)
+	for i := 1; i <= 100; i++ {
+		name, country := "p"+strconv.Itoa(i), []string{"X", "Y", "Z"}[i%3]
+		err = c.Write(&PagedPerson{name, i, country})
+		if err != nil {
+			t.Fatal(err)
+		}
+		people[name] = country
+	}
+
+	r, err := c.Reshard(4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- r.Wait() }()
+	for running := true; running; {
+		select {
+		case err = <-done:
+			running = false
+		default:
+			if syncErr := database.Sync(); syncErr != nil {
+				t.Fatal(syncErr)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReshardedPeople(t, c, people)
+
+	reloaded := newTestDatabase()
+	reloaded.RegisterType(&PagedPerson{})
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := reloaded.GetCollection("people")
+	if len(rc.Map.Shared) != 4 {
+		t.Fatal("expected 4 shards after the reload, got", len(rc.Map.Shared))
+	}
+	checkReshardedPeople(t, rc, people)
+}
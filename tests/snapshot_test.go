@@ -0,0 +1,167 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func snapshotNames(t *testing.T, s *db.Snapshot, c *db.Collection, age int) map[string]bool {
+	results, err := s.Scan(c, &ExamplePerson{Age: age})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, data := range results {
+		el, err := c.DecodeElement(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[el.Payload.(*ExamplePerson).FirstName] = true
+	}
+	return names
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%2 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	id0, _ := findPerson(t, c, "person0")
+	id1, _ := findPerson(t, c, "person1")
+
+	s := database.Snapshot()
+	err = c.Update(id0, &ExamplePerson{"renamed", 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.DeleteById(id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := database.Begin()
+	tx.Write(c, &ExamplePerson{"person10", 1})
+	tx.Write(c, &ExamplePerson{"person11", 2})
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = database.Optimize()
+	if err != db.ErrSnapshotsOpen {
+		t.Fatal("compaction was not postponed", err)
+	}
+
+	data, err := s.FindById(c, id0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil || el.Payload.(*ExamplePerson).FirstName != "person0" {
+		t.Fatal("snapshot sees the new version of the record", err)
+	}
+	_, err = s.ScanOne(c, &ExamplePerson{FirstName: "person0"})
+	if err != nil {
+		t.Fatal("old value of the unique key is not found", err)
+	}
+	_, err = s.ScanOne(c, &ExamplePerson{FirstName: "renamed"})
+	if err == nil {
+		t.Fatal("snapshot sees the new value of the unique key")
+	}
+	_, err = s.FindById(c, id1)
+	if err != nil {
+		t.Fatal("record deleted after the snapshot is not found", err)
+	}
+	names := snapshotNames(t, s, c, 1)
+	if len(names) != 5 || !names["person0"] || names["person10"] {
+		t.Fatal("unexpected records of the snapshot", names)
+	}
+	names = snapshotNames(t, s, c, 2)
+	if len(names) != 5 || !names["person1"] || names["renamed"] || names["person11"] {
+		t.Fatal("unexpected records of the snapshot", names)
+	}
+
+	// the current state is not affected by the snapshot
+	results, err := c.Scan(&ExamplePerson{Age: 2}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 6 {
+		t.Fatal("expected 6 current records, got", len(results))
+	}
+	_, err = c.FindById(id1, false)
+	if err == nil {
+		t.Fatal("deleted record is found")
+	}
+
+	s.Close()
+	_, err = s.FindById(c, id0)
+	if err != db.ErrSnapshotClosed {
+		t.Fatal("closed snapshot is readable")
+	}
+	_, err = database.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = database.Snapshot()
+	defer s.Close()
+	names = snapshotNames(t, s, c, 2)
+	if len(names) != 6 || !names["renamed"] || names["person1"] {
+		t.Fatal("unexpected records of the snapshot", names)
+	}
+}
+
+func TestSnapshotIsStableUnderWrites(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := findPerson(t, c, "person"+strconv.Itoa(i))
+		ids = append(ids, id)
+	}
+
+	s := database.Snapshot()
+	defer s.Close()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, id := range ids {
+			if c.Update(id, &ExamplePerson{"person" + strconv.Itoa(i), 2}) != nil {
+				return
+			}
+			c.Write(&ExamplePerson{"new" + strconv.Itoa(i), 1})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if n := len(snapshotNames(t, s, c, 1)); n != 20 {
+			t.Fatal("snapshot has changed under the writes, got", n)
+		}
+	}
+	wg.Wait()
+	if n := len(snapshotNames(t, s, c, 1)); n != 20 {
+		t.Fatal("snapshot has changed under the writes, got", n)
+	}
+	results, err := c.Scan(&ExamplePerson{Age: 2}, false)
+	if err != nil || len(results) != 20 {
+		t.Fatal("updates are lost", err)
+	}
+}
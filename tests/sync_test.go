@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestUnfinishedSyncIsRolledBack(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of the next synchronization leaves a torn generation and temporary files
+	leftovers := []string{
+		"collections/people/shard_0_meta.gob.gzip.1000",
+		"collections/people/people.json.gzip.1000",
+		"collections/people/map.index.tmp",
+	}
+	for _, name := range leftovers {
+		err = ioutil.WriteFile(name, []byte("torn"), os.ModePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.GetCollection("people").Size() != 5 {
+		t.Fatal("expected 5 objects, got", reloaded.GetCollection("people").Size())
+	}
+	for _, name := range leftovers {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatal(name, "was not removed")
+		}
+	}
+	err = reloaded.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
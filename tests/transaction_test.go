@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func checkCommittedTransaction(t *testing.T, database *db.Database, orderId string) {
+	orders, stock := database.GetCollection("orders"), database.GetCollection("stock")
+	if orders.Size() != 1 || stock.Size() != 2 {
+		t.Fatal("unexpected sizes of the collections", orders.Size(), stock.Size())
+	}
+	el, err := orders.FindElementById(orderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if el.Payload.(*ExamplePerson).FirstName != "order1" {
+		t.Fatal("wrong order was written")
+	}
+	_, p := findPerson(t, stock, "item0")
+	if p.Age != 9 {
+		t.Fatal("stock was not decremented, got", p.Age)
+	}
+	_, err = stock.ScanOne(&ExamplePerson{FirstName: "item2"}, false)
+	if err == nil {
+		t.Fatal("deleted item is still found")
+	}
+}
+
+func TestTransactionIsAppliedAtomically(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	orders, err := database.AddCollection("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stock, err := database.AddCollection("stock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		err = stock.Write(&ExamplePerson{"item" + strconv.Itoa(i), 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := findPerson(t, stock, "item"+strconv.Itoa(i))
+		ids = append(ids, id)
+	}
+
+	tx := database.Begin()
+	orderId, err := tx.Write(orders, &ExamplePerson{"order1", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Update(stock, ids[0], &ExamplePerson{"item0", 9})
+	tx.Delete(stock, ids[2])
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Commit() != db.ErrTransactionFinished {
+		t.Fatal("transaction was committed twice")
+	}
+	checkCommittedTransaction(t, database, orderId)
+
+	// the second change fails, so the first one is undone
+	tx = database.Begin()
+	tx.Write(orders, &ExamplePerson{"order2", 2})
+	tx.Update(stock, ids[1], &ExamplePerson{"item1", 8})
+	tx.Update(stock, ids[2], &ExamplePerson{"item2", 8})
+	err = tx.Commit()
+	if err == nil {
+		t.Fatal("transaction with a deleted record was committed")
+	}
+	// a unique key conflict is detected before anything is written
+	tx = database.Begin()
+	tx.Write(orders, &ExamplePerson{"order3", 3})
+	tx.Write(stock, &ExamplePerson{"item0", 1})
+	_, ok := tx.Commit().(*db.ErrDuplicateKey)
+	if !ok {
+		t.Fatal("duplicate key was not detected")
+	}
+	// rolled back transaction does nothing
+	tx = database.Begin()
+	tx.Write(orders, &ExamplePerson{"order4", 4})
+	tx.Rollback()
+	if tx.Commit() != db.ErrTransactionFinished {
+		t.Fatal("rolled back transaction was committed")
+	}
+
+	checkCommittedTransaction(t, database, orderId)
+	_, p := findPerson(t, stock, "item1")
+	if p.Age != 10 {
+		t.Fatal("change of the failed transaction is visible")
+	}
+	for _, c := range []*db.Collection{orders, stock} {
+		report, err := c.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Ok() {
+			t.Fatal("failed transaction has left garbage in", c.Name)
+		}
+	}
+	// keys reserved by the failed transactions are free
+	err = orders.Write(&ExamplePerson{"order2", 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the committed transaction is replayed after a crash
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, p = findPerson(t, reloaded.GetCollection("stock"), "item1")
+	if p.Age != 10 {
+		t.Fatal("change of the failed transaction was replayed")
+	}
+	_, err = reloaded.GetCollection("orders").ScanOne(&ExamplePerson{FirstName: "order3"}, false)
+	if err == nil {
+		t.Fatal("write of the failed transaction was replayed")
+	}
+	err = reloaded.GetCollection("orders").DeleteById(orderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloaded.GetCollection("orders").Write(&ExamplePerson{"order1", 1})
+	if err == nil {
+		t.Fatal("unique key of the replayed transaction is not reserved")
+	}
+}
+
+// a rolled back transaction leaves nothing in the range indexes and the capacities of the regular ones
+func TestTransactionRollbackRestoresIndexes(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.RegisterType(&RangePerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), 20 + i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.Write(&ExamplePerson{"gone", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	goneId := mustFindExampleId(t, c, "gone")
+	err = c.DeleteById(goneId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the update of the deleted record fails once the writes are applied
+	tx := database.Begin()
+	tx.Write(c, &RangePerson{"r1", 30, 1.5, rangeEpoch})
+	tx.Write(c, &ExamplePerson{"person9", 21})
+	tx.Update(c, goneId, &ExamplePerson{"gone", 2})
+	if tx.Commit() == nil {
+		t.Fatal("transaction with a deleted record was committed")
+	}
+
+	plan, err := c.Explain(&ExamplePerson{Age: 21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Driver.Estimate != 1 {
+		t.Fatal("capacity of the rolled back record is left, estimate", plan.Driver.Estimate)
+	}
+	results, err := c.ScanRange("Age", 0, nil, 100)
+	if err != nil || len(results) != 0 {
+		t.Fatal("rolled back record is found by its range index", len(results), err)
+	}
+	// Age is not a range index of the collection, so the records are read
+	elements, err := c.Query().Where("Age").Gt(22).Find()
+	if err != nil || len(elements) != 2 {
+		t.Fatal("expected 2 records, got", len(elements), err)
+	}
+}
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func checkDuplicate(t *testing.T, err error, value string) {
+	dup, ok := err.(*db.ErrDuplicateKey)
+	if !ok {
+		t.Fatal("expected a duplicate key error, got", err)
+	}
+	if dup.Field != "FirstName" || dup.Value != value {
+		t.Fatal("duplicate key error names a wrong key", dup.Field, dup.Value)
+	}
+}
+
+func TestUniqueKeyIsEnforcedAcrossShards(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Write(&ExamplePerson{"login", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every attempt lands on another shard
+	for i := 0; i < db.SHARD_COUNT; i++ {
+		checkDuplicate(t, c.Write(&ExamplePerson{"login", i + 2}), "login")
+	}
+	if c.Size() != 1 {
+		t.Fatal("expected 1 object, got", c.Size())
+	}
+
+	// a deleted record keeps its unique keys, so it could be restored
+	_, err = c.Delete(&ExamplePerson{FirstName: "login"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDuplicate(t, c.Write(&ExamplePerson{"login", 2}), "login")
+	// until it is dropped by the compaction
+	_, err = c.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Write(&ExamplePerson{"login", 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the reservations are restored on load, including the ones of the unsynchronized records
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := reloaded.GetCollection("people")
+	for i := 0; i < db.SHARD_COUNT; i++ {
+		checkDuplicate(t, rc.Write(&ExamplePerson{"person5", i}), "person5")
+	}
+	checkDuplicate(t, rc.Write(&ExamplePerson{"login", 3}), "login")
+}
@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func findPerson(t *testing.T, c *db.Collection, name string) (string, *ExamplePerson) {
+	data, err := c.ScanOne(&ExamplePerson{FirstName: name}, false)
+	if err != nil {
+		t.Fatal(name, err)
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return el.Id, el.Payload.(*ExamplePerson)
+}
+
+func checkUpdatedCollection(t *testing.T, c *db.Collection, renamedId string) {
+	if c.Size() != 12 {
+		t.Fatal("expected 12 objects, got", c.Size())
+	}
+	report, err := c.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok() {
+		t.Fatal("updated collection is damaged")
+	}
+	id, p := findPerson(t, c, "renamed")
+	if id != renamedId || p.Age != 5 {
+		t.Fatal("record was not updated in place", id, p.Age)
+	}
+	data, err := c.FindById(renamedId, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil || el.Payload.(*ExamplePerson).FirstName != "renamed" {
+		t.Fatal("old version is found by id", err)
+	}
+	_, p = findPerson(t, c, "person3")
+	if p.Age != 2 {
+		t.Fatal("freed unique key was not reused")
+	}
+	results, err := c.Scan(&ExamplePerson{Age: 7}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatal("expected 4 updated records, got", len(results))
+	}
+	_, err = c.Scan(&ExamplePerson{Age: 1}, false)
+	if err == nil {
+		t.Fatal("stale keys of the regular index are still found")
+	}
+	_, p = findPerson(t, c, "person0")
+	if p.Age != 9 {
+		t.Fatal("record was not upserted")
+	}
+}
+
+func TestUpdateKeepsIdAndMovesKeys(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%2 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, _ := findPerson(t, c, "person3")
+	err = c.Update(id, &ExamplePerson{"renamed", 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Write(&ExamplePerson{"person3", 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Update(id, &ExamplePerson{"person5", 5}).(*db.ErrDuplicateKey); !ok {
+		t.Fatal("record was renamed into a taken unique key")
+	}
+
+	n, err := c.UpdateWhere(&ExamplePerson{Age: 1}, func(payload db.CustomStructure) (db.CustomStructure, error) {
+		p := payload.(*ExamplePerson)
+		if p.FirstName == "person0" {
+			return nil, nil
+		}
+		p.Age = 7
+		return p, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatal("expected 4 updated records, got", n)
+	}
+
+	zeroId, _ := findPerson(t, c, "person0")
+	upserted, err := c.Upsert(&ExamplePerson{"person0", 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upserted != zeroId {
+		t.Fatal("upsert has created a new record")
+	}
+	_, err = c.Upsert(&ExamplePerson{"newcomer", 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUpdatedCollection(t, c, id)
+
+	// the updates are replayed from the write-ahead log
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := reloaded.GetCollection("people")
+	checkUpdatedCollection(t, rc, id)
+
+	// the old versions are reclaimed
+	reclaimed, err := rc.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed <= 0 {
+		t.Fatal("old versions were not reclaimed")
+	}
+	checkUpdatedCollection(t, rc, id)
+}
@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"os"
+	"shardb/db"
+	"testing"
+)
+
+func TestVerifyDetectsCorruption(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first record goes to the shard #1
+	err = c.Write(&ExamplePerson{"first", 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok() {
+		t.Fatal("fresh collection is reported as damaged")
+	}
+
+	// flip a byte of the payload and append a record nobody refers to
+	f, err := os.OpenFile("collections/people/"+db.ShardDataName(1), os.O_RDWR, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, db.RECORD_HEADER_SIZE+2)
+	b[0] ^= 0xff
+	f.WriteAt(b, db.RECORD_HEADER_SIZE+2)
+	f.Close()
+	f, err = os.OpenFile("collections/people/"+db.ShardDataName(2), os.O_RDWR|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(db.EncodeRecord([]byte("orphan")))
+	f.Close()
+
+	_, err = c.ScanOne(&ExamplePerson{FirstName: "first"}, false)
+	if err != db.ErrCorruptedRecord {
+		t.Fatal("corrupted record was read without an error:", err)
+	}
+
+	report, err = c.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Shards[1].Corrupted) != 1 || len(report.Shards[1].Dangling) != 0 {
+		t.Fatal("corrupted record was not detected", report.Shards[1])
+	}
+	if len(report.Shards[2].Orphaned) != 1 {
+		t.Fatal("orphaned record was not detected", report.Shards[2])
+	}
+}
@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"shardb/db"
+	"sync"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Write(&ExamplePerson{"counter", 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := findPerson(t, c, "counter")
+	el, err := c.FindElementById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if el.Version != 1 {
+		t.Fatal("expected version 1 of a new record, got", el.Version)
+	}
+
+	version, err := c.CompareAndSwap(id, 1, &ExamplePerson{"counter", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatal("expected version 2, got", version)
+	}
+	_, err = c.CompareAndSwap(id, 1, &ExamplePerson{"counter", 100})
+	conflict, ok := err.(*db.ErrVersionConflict)
+	if !ok {
+		t.Fatal("expected a version conflict, got", err)
+	}
+	if conflict.Id != id || conflict.Expected != 1 || conflict.Actual != 2 {
+		t.Fatal("version conflict is misreported", conflict)
+	}
+
+	// concurrent read-modify-write cycles do not lose updates
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; {
+				el, err := c.FindElementById(id)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				p := el.Payload.(*ExamplePerson)
+				p.Age++
+				_, err = c.CompareAndSwap(id, el.Version, p)
+				if _, ok := err.(*db.ErrVersionConflict); ok {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, coll := range []*db.Collection{c, reloaded.GetCollection("people")} {
+		el, err = coll.FindElementById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if el.Payload.(*ExamplePerson).Age != 81 || el.Version != 82 {
+			t.Fatal("updates were lost", el.Payload.(*ExamplePerson).Age, el.Version)
+		}
+	}
+}
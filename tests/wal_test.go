@@ -0,0 +1,221 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"shardb/db"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// runs the test inside of a fresh directory, the database keeps its files relative to the working directory
+func enterTempDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "shardb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestDatabase() *db.Database {
+	database := db.NewDatabase("test")
+	database.RegisterType(&ExamplePerson{})
+	return database
+}
+
+func TestWalReplayAfterCrash(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i%3 + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = c.Delete(&ExamplePerson{FirstName: "person4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the database is never synchronized, as if the process has crashed
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := reloaded.GetCollection("people")
+	if rc == nil {
+		t.Fatal("collection was not loaded")
+	}
+	if rc.Size() != 9 {
+		t.Fatal("expected 9 objects after the replay, got", rc.Size())
+	}
+	data, err := rc.ScanOne(&ExamplePerson{FirstName: "person7"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := rc.DecodeElement(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if el.Payload.(*ExamplePerson).Age != 2 {
+		t.Fatal("replayed record is damaged")
+	}
+}
+
+func TestWalCheckpointOnSync(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	database.SetDurability(db.WAL_SYNC_GROUP)
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Write(&ExamplePerson{"late", 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.GetCollection("people").Size() != 6 {
+		t.Fatal("expected 6 objects, got", reloaded.GetCollection("people").Size())
+	}
+}
+
+// the entries written after a restart are numbered above the synced ones, so they are replayed
+func TestWalReplayAfterRestart(t *testing.T) {
+	defer enterTempDir(t)()
+
+	database := newTestDatabase()
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestDatabase()
+	err = restarted.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 110; i++ {
+		err = restarted.GetCollection("people").Write(&ExamplePerson{"person" + strconv.Itoa(i), i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the process crashes without the sync
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.GetCollection("people").Size() != 110 {
+		t.Fatal("expected 110 objects, got", reloaded.GetCollection("people").Size())
+	}
+}
+
+// waits for the number of the goroutines to settle at n
+func waitGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() != n {
+		if time.Now().After(deadline) {
+			t.Fatal("expected", n, "goroutines, got", runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// only the logs in the group commit mode run in the background, a closed database leaves nothing running
+func TestWalGroupCommitLoopAndClose(t *testing.T) {
+	defer enterTempDir(t)()
+
+	base := runtime.NumGoroutine()
+	database := newTestDatabase()
+	collections := make([]*db.Collection, 0, 3)
+	for i := 0; i < 3; i++ {
+		c, err := database.AddCollection("people" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		collections = append(collections, c)
+	}
+	waitGoroutines(t, base)
+
+	// every collection and the log of the transactions
+	database.SetDurability(db.WAL_SYNC_GROUP)
+	waitGoroutines(t, base+4)
+	err := collections[0].Write(&ExamplePerson{"person1", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.SetDurability(db.WAL_SYNC_ALWAYS)
+	waitGoroutines(t, base)
+	database.SetDurability(db.WAL_SYNC_GROUP)
+	waitGoroutines(t, base+4)
+
+	err = database.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitGoroutines(t, base)
+	err = collections[1].Write(&ExamplePerson{"person2", 2})
+	if err == nil {
+		t.Fatal("closed database was written")
+	}
+
+	// the acknowledged changes are found after the reopen
+	reloaded := newTestDatabase()
+	err = reloaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	_, err = reloaded.GetCollection("people0").ScanOne(&ExamplePerson{FirstName: "person1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}